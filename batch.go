@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchRange is the most of a file of a batch fetched in one turn of the rangeQueue
+const batchRange = 8 << 20
+
+// batchJob is a single file of a batch download
+type batchJob struct {
+	Path   string `json:"path"`
+	Output string `json:"output"`
+	length int
+	etag   string
+	mtime  time.Time // zero if unknown; applied to the output when known
+}
+
+// session keeps the connections of a run alive across downloads, together with the
+// bandwidth measurements of every path, so later downloads start with warm estimates
+type session struct {
+	conns      []MonitoredMpConn
+	connsReady []chan struct{}
+	bw         []*BwCounter // nil until the first download has measured the paths
+	mux        sync.Mutex   // protects bw
+	queue      rangeQueue   // schedules the ranges of the concurrent downloads
+}
+
+// rangeQueue lets the downloads of a session fetch their ranges one at a time, each split
+// over every path.  The next turn goes to the range of the file with the fewest bytes
+// left, first come first served among equals, so that small files get through between
+// the ranges of large ones rather than sharing the paths with them.
+type rangeQueue struct {
+	mux     sync.Mutex
+	busy    bool
+	waiting []*rangeTurn // in the order they came
+}
+
+type rangeTurn struct {
+	left  uint // bytes of the file left; unknownLength is the most
+	ready chan struct{}
+}
+
+// acquire waits for the turn of a range of a file with left bytes left
+func (q *rangeQueue) acquire(left int) {
+	q.mux.Lock()
+	if !q.busy {
+		q.busy = true
+		q.mux.Unlock()
+		return
+	}
+	turn := &rangeTurn{left: uint(left), ready: make(chan struct{})}
+	q.waiting = append(q.waiting, turn)
+	q.mux.Unlock()
+	<-turn.ready
+}
+
+// release passes the turn on to the next range
+func (q *rangeQueue) release() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if len(q.waiting) == 0 {
+		q.busy = false
+		return
+	}
+	next := 0
+	for i, turn := range q.waiting {
+		if turn.left < q.waiting[next].left {
+			next = i
+		}
+	}
+	turn := q.waiting[next]
+	q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+	close(turn.ready)
+}
+
+func newSession(servers []string) *session {
+	s := &session{
+		conns:      make([]MonitoredMpConn, len(servers)),
+		connsReady: make([]chan struct{}, len(servers)),
+	}
+	for i := range servers {
+		s.connsReady[i] = make(chan struct{})
+		go func(i int) {
+			s.conns[i] = NewMonitoredMpConn(servers[i], i)
+			progress.addPath(s.conns[i])
+			metrics.addPath(s.conns[i])
+			close(s.connsReady[i])
+		}(i)
+	}
+	return s
+}
+
+// warmCounters returns fresh counters carrying the latest bandwidth measurements
+func (s *session) warmCounters() []*BwCounter {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.bw == nil {
+		return nil
+	}
+	ret := make([]*BwCounter, len(s.bw))
+	for idx := range s.bw {
+		ret[idx] = s.bw[idx].DuplicateBwCounter(idx)
+	}
+	return ret
+}
+
+// keepCounters remembers the measurements of a finished download for later ones
+func (s *session) keepCounters(bw []*BwCounter) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.bw = bw
+}
+
+// fastestConn returns the index of the connection with the lowest RTT
+func (s *session) fastestConn() int {
+	best := 0
+	for idx := range s.conns {
+		<-s.connsReady[idx]
+		if s.conns[idx].MeasureRtt() < s.conns[best].MeasureRtt() {
+			best = idx
+		}
+	}
+	return best
+}
+
+// stat asks the fastest path for the first byte of the job's file to learn its total
+// length, ETag and modification time
+func (s *session) stat(job *batchJob) {
+	rs := s.conns[s.fastestConn()].StartRequest(DoubleRangedGet(job.Path, 0, 1))
+	if rs.response == nil {
+		job.length = unknownLength
+		return
+	}
+	rs.response.Body.Close()
+	switch rs.response.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		job.length = getTotalLength(rs.response)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// empty file
+		job.length = 0
+	default:
+		log.Fatalf("unexpected status code for %s: %d", job.Path, rs.response.StatusCode)
+	}
+	job.etag = rs.response.Header.Get("ETag")
+	if lm := rs.response.Header.Get("Last-Modified"); lm != "" {
+		if t, err := http.ParseTime(lm); err == nil {
+			job.mtime = t
+		}
+	}
+}
+
+// download fetches p with the multipath engine into out, reusing the session's
+// connections and bandwidth measurements.  The file is fetched in ranges of batchRange
+// bytes at most, each in a turn of the session's queue.  length may be unknownLength,
+// which is streamed in a single turn.  Returns the length of the downloaded file.
+func (s *session) download(p string, length int, out *os.File) int {
+	if length == unknownLength {
+		s.queue.acquire(unknownLength)
+		defer s.queue.release()
+		idx := s.fastestConn()
+		rs := s.conns[idx].StartRequest(LeftRangedGet(p, 0))
+		if rs.response == nil {
+			fatal("start stream", fmt.Errorf("request for %s failed", p))
+		}
+		// the streaming path has to come first
+		conns := append([]MonitoredMpConn{s.conns[idx]}, s.conns[:idx]...)
+		conns = append(conns, s.conns[idx+1:]...)
+		connsReady := append([]chan struct{}{s.connsReady[idx]}, s.connsReady[:idx]...)
+		connsReady = append(connsReady, s.connsReady[idx+1:]...)
+		return streamRequest(p, conns, connsReady, &rs, out)
+	}
+	buf := make([]byte, length)
+	for start := 0; start < length; {
+		s.queue.acquire(length - start)
+		// the latest measurements, of this file or another one
+		bw := s.warmCounters()
+		if bw == nil {
+			bw = cachedCounters(s.conns, s.connsReady)
+		}
+		if bw == nil && start == 0 && warmsUp(length) {
+			bw, start = warmup(p, s.conns, s.connsReady, rangeBuf{b: buf}, nil), warmupBytes
+		}
+		if bw == nil {
+			bw = newBwCounters(s.conns, s.connsReady)
+		}
+		end := start + batchRange
+		if end > length {
+			end = length
+		}
+		// the deepest fragment has the latest measurements
+		s.keepCounters(nSplitRequest(p, s.conns, s.connsReady, bw, start, end, rangeBuf{b: buf}, nil))
+		s.queue.release()
+		start = end
+	}
+	_, err := out.Write(buf)
+	fatal("write", err)
+	return length
+}
+
+func (s *session) Close() {
+	for idx := range s.conns {
+		<-s.connsReady[idx]
+		s.conns[idx].Close()
+	}
+}
+
+// readBatchManifest reads the list of files of a batch download.  The file is either a
+// JSON array of {"path": ..., "output": ...} objects or a plain list with one
+// "<path> [output]" per line; a missing output defaults to the base name of the path.
+func readBatchManifest(name string) []*batchJob {
+	content, err := ioutil.ReadFile(name)
+	fatal("read batch manifest", err)
+	var jobs []*batchJob
+	if trimmed := strings.TrimSpace(string(content)); strings.HasPrefix(trimmed, "[") {
+		fatal("parse batch manifest", json.Unmarshal(content, &jobs))
+	} else {
+		scanner := bufio.NewScanner(strings.NewReader(trimmed))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			job := &batchJob{Path: fields[0]}
+			if len(fields) > 1 {
+				job.Output = fields[1]
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	for _, job := range jobs {
+		if job.Output == "" {
+			job.Output = path.Base(job.Path)
+		}
+	}
+	return jobs
+}
+
+// runBatch downloads all jobs over the session, at most concurrency at a time
+func runBatch(s *session, jobs []*batchJob, concurrency int) {
+	s.statAll(jobs)
+	for _, job := range jobs {
+		if job.length > 0 {
+			progress.expect(job.length)
+		}
+	}
+	s.runQueue(jobs, concurrency)
+}
+
+// statAll fetches the metadata of all jobs concurrently
+func (s *session) statAll(jobs []*batchJob) {
+	wg := sync.WaitGroup{}
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *batchJob) {
+			s.stat(job)
+			wg.Done()
+		}(job)
+	}
+	wg.Wait()
+}
+
+// runQueue downloads stat'ed jobs, at most concurrency at a time, shortest first.  The
+// downloads running at the same time take turns for their ranges in the session's
+// rangeQueue, the file with the fewest bytes left first: a small file started next to a
+// large one is fetched between two ranges of it, over every path.
+func (s *session) runQueue(jobs []*batchJob, concurrency int) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		// unknown lengths go last
+		return uint(jobs[i].length) < uint(jobs[j].length)
+	})
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	wg := sync.WaitGroup{}
+	queue := make(chan *batchJob)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				start := time.Now()
+				fatal("create output directory", os.MkdirAll(filepath.Dir(job.Output), 0755))
+				outFile, err := os.OpenFile(job.Output, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+				fatal("open file", err)
+				length := s.download(job.Path, job.length, outFile)
+				sum := hashFile(outFile)
+				outFile.Close()
+				if !job.mtime.IsZero() {
+					fatal("set mtime", os.Chtimes(job.Output, job.mtime, job.mtime))
+				}
+				logEvent("download", -1, eventFields{"url": job.Path, "length": length,
+					"duration": msec(time.Since(start))})
+				logf("%s (%d bytes, sha256 %x) %v\n", job.Output, length, sum, time.Since(start))
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRangeQueue(t *testing.T) {
+	var q rangeQueue
+	q.acquire(1000)
+	order := make(chan int, 4)
+	for _, left := range []int{300, 100, unknownLength, 200} {
+		go func(left int) {
+			q.acquire(left)
+			order <- left
+			q.release()
+		}(left)
+		// queued in this order
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.release()
+	for _, want := range []int{100, 200, 300, unknownLength} {
+		if left := <-order; left != want {
+			t.Errorf("range of a file with %d bytes left went before the one with %d", left, want)
+		}
+	}
+}
+
+func TestRunQueue(t *testing.T) {
+	files := map[string][]byte{
+		"/large": randomContent(batchRange + batchRange/2),
+		"/small": randomContent(300 << 10),
+		"/empty": {},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler, LinkConfig{}, LinkConfig{}, LinkConfig{})
+	defer stop()
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newSession(servers)
+	defer s.Close()
+	var jobs []*batchJob
+	for name := range files {
+		jobs = append(jobs, &batchJob{Path: name, Output: filepath.Join(dir, name)})
+	}
+	runBatch(s, jobs, 2)
+	for name, content := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s: %d bytes downloaded differ from the %d bytes of content", name, len(got), len(content))
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"mphttp/dep/http2"
+)
+
+var benchArgs struct {
+	Profiles   []string `arg:"--profile,separate" help:"link profile of the local servers: a built-in one (unshaped, equal, asymmetric, lossy) or three option lists of serve separated by '/'" placeholder:"<profile>"`
+	Schedulers []string `arg:"--scheduler,separate" help:"scheduler to compare (default: all)" placeholder:"<name>"`
+	Sizes      []string `arg:"--size,separate" help:"size of the files served locally, e.g. 8MB" placeholder:"<size>"`
+	Paths      []string `arg:"-t,--path,separate" help:"with servers given: resource to download" placeholder:"<file>"`
+	Reps       int      `arg:"-n" help:"repetitions of every scenario" placeholder:"<n>"`
+	Format     string   `arg:"-f" help:"report format: table, csv or json" placeholder:"<format>"`
+	Output     string   `arg:"-o" help:"write the report to <file> instead of stdout" placeholder:"<file>"`
+	Servers    []string `arg:"positional" help:"remote servers; local ones with emulated links are started if omitted"`
+}
+
+// benchProfiles are the built-in link profiles, one link per path
+var benchProfiles = map[string][]LinkConfig{
+	"unshaped": {{}, {}, {}},
+	"equal": {
+		{Rate: 2e6, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+		{Rate: 2e6, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+		{Rate: 2e6, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+	},
+	"asymmetric": {
+		{Rate: 4e6, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		{Rate: 2e6, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+		{Rate: 1e6, Delay: 40 * time.Millisecond, Queue: 128 << 10},
+	},
+	"lossy": {
+		{Rate: 2e6, Delay: 20 * time.Millisecond, Loss: 0.01, Queue: 128 << 10},
+		{Rate: 2e6, Delay: 20 * time.Millisecond, Loss: 0.01, Queue: 128 << 10},
+		{Rate: 2e6, Delay: 20 * time.Millisecond, Loss: 0.01, Queue: 128 << 10},
+	},
+}
+
+// benchScenario is one cell of the benchmark matrix
+type benchScenario struct {
+	Profile   string `json:"profile"`
+	Scheduler string `json:"scheduler"`
+	Path      string `json:"path"`
+	Size      int    `json:"size"`
+}
+
+// benchRun is the outcome of a single download
+type benchRun struct {
+	benchScenario
+	Rep         int       `json:"rep"`
+	Seconds     float64   `json:"seconds"`
+	Goodput     float64   `json:"goodput"`               // bytes per second
+	PathBytes   []int64   `json:"path_bytes"`            // response body bytes per path
+	Utilization []float64 `json:"utilization,omitempty"` // path goodput over link rate, if known
+	Duplicated  int64     `json:"duplicated"`            // body bytes received more than once
+	Wasted      int64     `json:"wasted"`                // body bytes received but never read: past choke points, or of responses closed early
+	Overhead    int64     `json:"overhead"`              // bytes read off the connections that never made it into a body: the waste and the HTTP/2 framing
+}
+
+// benchSummary aggregates the runs of a scenario
+type benchSummary struct {
+	benchScenario
+	Runs        int       `json:"runs"`
+	Seconds     float64   `json:"seconds"` // mean
+	StdDev      float64   `json:"stddev"`  // of Seconds
+	Goodput     float64   `json:"goodput"`
+	Utilization []float64 `json:"utilization,omitempty"`
+	Duplicated  float64   `json:"duplicated"`
+	Wasted      float64   `json:"wasted"`
+	Overhead    float64   `json:"overhead"`
+}
+
+// parseProfile returns a built-in profile, or parses one given as option lists of
+// parseListenSpec separated by '/'
+func parseProfile(s string) ([]LinkConfig, error) {
+	if links, ok := benchProfiles[s]; ok {
+		return links, nil
+	}
+	var links []LinkConfig
+	for _, opts := range strings.Split(s, "/") {
+		spec, err := parseListenSpec("127.0.0.1:0," + opts)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, spec.down)
+	}
+	if len(links) != serverCount {
+		return nil, fmt.Errorf("profile %q must have %d links", s, serverCount)
+	}
+	return links, nil
+}
+
+// serveLinks serves handler over TLS on one loopback listener per link, returning the
+// server addresses and a function closing the listeners
+func serveLinks(handler http.Handler, links ...LinkConfig) ([]string, func(), error) {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert()},
+		NextProtos:   []string{http2.NextProtoTLS},
+	}
+	var servers []string
+	var listeners []net.Listener
+	stop := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, link := range links {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		servers, listeners = append(servers, l.Addr().String()), append(listeners, l)
+		go serveListener(&linkListener{Listener: l, down: link}, tlsConfig, handler)
+	}
+	return servers, stop, nil
+}
+
+// benchContent serves random content of the given sizes at /<size>
+func benchContent(sizes []int) http.Handler {
+	content := map[string][]byte{}
+	for _, size := range sizes {
+		buf := make([]byte, size)
+		rand.Read(buf)
+		content["/"+strconv.Itoa(size)] = buf
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, ok := content[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+	})
+}
+
+// benchDownload downloads path once, measuring what the run cost on every path
+func benchDownload(sc benchScenario, rep int, servers []string, links []LinkConfig) benchRun {
+	out, err := ioutil.TempFile("", "mphttp-bench")
+	fatal("temp file", err)
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	res := download(sc.Path, servers, out)
+	sc.Size = res.Length
+	run := benchRun{
+		benchScenario: sc,
+		Rep:           rep,
+		Seconds:       res.Duration.Seconds(),
+		Goodput:       float64(res.Length) / res.Duration.Seconds(),
+	}
+	var body, data, wire int64
+	for i, stats := range res.Stats {
+		run.PathBytes = append(run.PathBytes, stats.Body)
+		body += stats.Body
+		data += stats.Data
+		wire += stats.Wire
+		if links != nil {
+			if rate := links[i].rate(); rate > 0 {
+				run.Utilization = append(run.Utilization, float64(stats.Body)/res.Duration.Seconds()/float64(rate))
+			} else {
+				run.Utilization = append(run.Utilization, math.NaN())
+			}
+		}
+	}
+	run.Duplicated = body - int64(res.Length)
+	run.Wasted = data - body
+	run.Overhead = wire - body
+	return run
+}
+
+func summarize(runs []benchRun) []benchSummary {
+	var summaries []benchSummary
+	index := map[benchScenario]int{}
+	var seconds [][]float64
+	for _, run := range runs {
+		i, ok := index[run.benchScenario]
+		if !ok {
+			i = len(summaries)
+			index[run.benchScenario] = i
+			summaries = append(summaries, benchSummary{
+				benchScenario: run.benchScenario,
+				Utilization:   make([]float64, len(run.Utilization)),
+			})
+			seconds = append(seconds, nil)
+		}
+		s := &summaries[i]
+		s.Runs++
+		s.Goodput += run.Goodput
+		s.Duplicated += float64(run.Duplicated)
+		s.Wasted += float64(run.Wasted)
+		s.Overhead += float64(run.Overhead)
+		for j, u := range run.Utilization {
+			s.Utilization[j] += u
+		}
+		seconds[i] = append(seconds[i], run.Seconds)
+	}
+	for i := range summaries {
+		s := &summaries[i]
+		n := float64(s.Runs)
+		s.Goodput /= n
+		s.Duplicated /= n
+		s.Wasted /= n
+		s.Overhead /= n
+		for j := range s.Utilization {
+			s.Utilization[j] /= n
+		}
+		for _, sec := range seconds[i] {
+			s.Seconds += sec / n
+		}
+		for _, sec := range seconds[i] {
+			s.StdDev += (sec - s.Seconds) * (sec - s.Seconds) / n
+		}
+		s.StdDev = math.Sqrt(s.StdDev)
+	}
+	return summaries
+}
+
+func formatUtilization(util []float64) string {
+	var fields []string
+	for _, u := range util {
+		if math.IsNaN(u) {
+			fields = append(fields, "-")
+		} else {
+			fields = append(fields, fmt.Sprintf("%.0f%%", u*100))
+		}
+	}
+	return strings.Join(fields, "/")
+}
+
+// writeBenchReport writes the summaries as a table, as CSV, or as JSON together with
+// every run
+func writeBenchReport(w io.Writer, format string, runs []benchRun, summaries []benchSummary) error {
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "PROFILE\tSCHEDULER\tPATH\tSIZE\tRUNS\tTIME\tSTDDEV\tGOODPUT\tUTILIZATION\tDUPLICATED\tWASTED\tOVERHEAD")
+		for _, s := range summaries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%.3fs\t%.3fs\t%.0f B/s\t%s\t%.0f\t%.0f\t%.0f\n",
+				s.Profile, s.Scheduler, s.Path, s.Size, s.Runs, s.Seconds, s.StdDev, s.Goodput,
+				formatUtilization(s.Utilization), s.Duplicated, s.Wasted, s.Overhead)
+		}
+		return tw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"profile", "scheduler", "path", "size", "runs", "seconds", "stddev",
+			"goodput", "utilization", "duplicated", "wasted", "overhead"})
+		for _, s := range summaries {
+			cw.Write([]string{s.Profile, s.Scheduler, s.Path, strconv.Itoa(s.Size),
+				strconv.Itoa(s.Runs), fmt.Sprintf("%.6f", s.Seconds), fmt.Sprintf("%.6f", s.StdDev),
+				fmt.Sprintf("%.0f", s.Goodput), formatUtilization(s.Utilization),
+				fmt.Sprintf("%.0f", s.Duplicated), fmt.Sprintf("%.0f", s.Wasted), fmt.Sprintf("%.0f", s.Overhead)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		// NaN has no JSON representation: unknown utilization becomes -1
+		for i := range runs {
+			runs[i].Utilization = jsonUtilization(runs[i].Utilization)
+		}
+		for i := range summaries {
+			summaries[i].Utilization = jsonUtilization(summaries[i].Utilization)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Runs    []benchRun     `json:"runs"`
+			Summary []benchSummary `json:"summary"`
+		}{runs, summaries})
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+func jsonUtilization(util []float64) []float64 {
+	ret := make([]float64, len(util))
+	for i, u := range util {
+		if math.IsNaN(u) {
+			u = -1
+		}
+		ret[i] = u
+	}
+	return ret
+}
+
+func benchMain(args []string) {
+	benchArgs.Reps = 3
+	benchArgs.Format = "table"
+	p := mustParseSubcommand("bench", &benchArgs, args)
+	switch benchArgs.Format {
+	case "table", "csv", "json":
+	default:
+		p.Fail("unknown format " + benchArgs.Format)
+	}
+	if len(benchArgs.Schedulers) == 0 {
+		for name := range schedulers {
+			benchArgs.Schedulers = append(benchArgs.Schedulers, name)
+		}
+		sort.Strings(benchArgs.Schedulers)
+	}
+	for _, name := range benchArgs.Schedulers {
+		if _, ok := schedulers[name]; !ok {
+			p.Fail("unknown scheduler " + name + "; known: " + schedulerNames())
+		}
+	}
+
+	// what to download from which servers, for every profile
+	type target struct {
+		profile string
+		links   []LinkConfig // nil for remote servers
+		servers []string
+		paths   []string
+	}
+	var targets []target
+	if len(benchArgs.Servers) > 0 {
+		if len(benchArgs.Servers) != serverCount {
+			p.Fail("must provide exactly 3 servers")
+		}
+		if len(benchArgs.Paths) == 0 {
+			p.Fail("must provide --path with remote servers")
+		}
+		normalizeServers(benchArgs.Servers)
+		targets = append(targets, target{profile: "remote", servers: benchArgs.Servers,
+			paths: benchArgs.Paths})
+	} else {
+		if len(benchArgs.Profiles) == 0 {
+			benchArgs.Profiles = []string{"equal", "asymmetric"}
+		}
+		if len(benchArgs.Sizes) == 0 {
+			benchArgs.Sizes = []string{"1MB", "8MB"}
+		}
+		var sizes []int
+		var paths []string
+		for _, s := range benchArgs.Sizes {
+			size, err := parseRate(s)
+			if err != nil || size <= 0 {
+				p.Fail("bad size " + s)
+			}
+			sizes = append(sizes, int(size))
+			paths = append(paths, "/"+strconv.Itoa(int(size)))
+		}
+		handler := benchContent(sizes)
+		for _, name := range benchArgs.Profiles {
+			links, err := parseProfile(name)
+			if err != nil {
+				p.Fail(err.Error())
+			}
+			servers, stop, err := serveLinks(handler, links...)
+			fatal("start local servers", err)
+			defer stop()
+			targets = append(targets, target{profile: name, links: links, servers: servers,
+				paths: paths})
+		}
+	}
+
+	var runs []benchRun
+	for _, t := range targets {
+		for _, name := range benchArgs.Schedulers {
+			scheduler = schedulers[name]
+			for _, path := range t.paths {
+				for rep := 0; rep < benchArgs.Reps; rep++ {
+					sc := benchScenario{Profile: t.profile, Scheduler: name, Path: path}
+					fmt.Printf("bench: %s, %s, %s, run %d\n", t.profile, name, path, rep+1)
+					runs = append(runs, benchDownload(sc, rep, t.servers, t.links))
+				}
+			}
+		}
+	}
+
+	w := os.Stdout
+	if benchArgs.Output != "" {
+		f, err := os.Create(benchArgs.Output)
+		fatal("create report", err)
+		defer f.Close()
+		w = f
+	}
+	fatal("write report", writeBenchReport(w, benchArgs.Format, runs, summarize(runs)))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	links, err := parseProfile("asymmetric")
+	if err != nil || len(links) != 3 || links[0].Rate != 4e6 {
+		t.Errorf("parseProfile(asymmetric) = %v, %v", links, err)
+	}
+	links, err = parseProfile("rate=1MB,delay=10ms/rate=2MB/loss=1%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links[0].Rate != 1e6 || links[0].Delay != 10*time.Millisecond || links[1].Rate != 2e6 ||
+		links[2].Loss != 0.01 {
+		t.Errorf("parseProfile = %v", links)
+	}
+	for _, bad := range []string{"fast", "rate=1MB/rate=2MB", "rate=1MB/rate=2MB/rate=x"} {
+		if _, err := parseProfile(bad); err == nil {
+			t.Errorf("profile %q accepted", bad)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	a := benchScenario{Profile: "equal", Scheduler: "static", Path: "/1", Size: 1}
+	b := a
+	b.Scheduler = "equal"
+	runs := []benchRun{
+		{benchScenario: a, Seconds: 1, Goodput: 10, Utilization: []float64{0.5, math.NaN()}, Wasted: 4,
+			Overhead: 6},
+		{benchScenario: b, Seconds: 5},
+		{benchScenario: a, Seconds: 3, Goodput: 20, Utilization: []float64{1, math.NaN()}, Duplicated: 2},
+	}
+	summaries := summarize(runs)
+	if len(summaries) != 2 {
+		t.Fatalf("%d summaries, want 2", len(summaries))
+	}
+	s := summaries[0]
+	if s.benchScenario != a || s.Runs != 2 || s.Seconds != 2 || s.StdDev != 1 || s.Goodput != 15 ||
+		s.Duplicated != 1 || s.Wasted != 2 || s.Overhead != 3 || s.Utilization[0] != 0.75 || !math.IsNaN(s.Utilization[1]) {
+		t.Errorf("summary = %+v", s)
+	}
+	if summaries[1].benchScenario != b || summaries[1].Runs != 1 || summaries[1].StdDev != 0 {
+		t.Errorf("summary = %+v", summaries[1])
+	}
+
+	var buf bytes.Buffer
+	if err := writeBenchReport(&buf, "csv", runs, summaries); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1][1] != "static" || records[1][8] != "75%/-" {
+		t.Errorf("csv report = %v", records)
+	}
+
+	buf.Reset()
+	if err := writeBenchReport(&buf, "json", runs, summaries); err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Runs    []benchRun
+		Summary []benchSummary
+	}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Runs) != 3 || len(report.Summary) != 2 || report.Summary[0].Utilization[1] != -1 {
+		t.Errorf("json report = %+v", report)
+	}
+}
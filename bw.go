@@ -1,23 +1,21 @@
 package main
 
 import (
-	"fmt"
-	"os"
 	"sync"
-	"time"
 )
 
-var connDataMap struct {
-	m map[int]*os.File
-	mux sync.Mutex
-}
-
 type BwCounter struct {
-	total       int64
-	historyRate []int64
-	rateSum     int64
-	connId      int
-	offset      int
+	total  int64
+	est    BandwidthEstimator
+	connId int
+	offset int
+	// busySum and busySamples are the sum and count of the rate samples from the first with
+	// progress on a range to the last, see SustainedRate; idleSamples are those without
+	// since, counted once progress resumes.  delivering tells if the range made progress.
+	busySum     int64
+	busySamples int64
+	idleSamples int64
+	delivering  bool
 	mux         sync.Mutex // protects all above
 }
 
@@ -25,25 +23,13 @@ func (wc *BwCounter) Write(p []byte) (int, error) {
 	if wc.offset < 0 {
 		panic("BwCounter offset uninitialized when first write happened")
 	}
-	connDataMap.mux.Lock()
-	if connDataMap.m == nil {
-		connDataMap.m = make(map[int]*os.File)
-	}
-	if connDataMap.m[wc.connId] == nil {
-		var err error
-		connDataMap.m[wc.connId], err = os.OpenFile(fmt.Sprintf("%d.dat", wc.connId),
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-		fatal("open connection data file", err)
-	}
-	connDataMap.mux.Unlock()
 	n := len(p)
 	wc.mux.Lock()
 	wc.total += int64(n)
 	//fmt.Println("Connection", wc.connId, wc.total)
-	connDataMap.mux.Lock()
-	fmt.Fprintf(connDataMap.m[wc.connId], "%d %d\n", time.Since(globalStart)/time.Millisecond,
-		wc.total+int64(wc.offset))
-	connDataMap.mux.Unlock()
+	if report != nil {
+		report.progress(wc.connId, wc.offset, wc.total+int64(wc.offset), n)
+	}
 	wc.mux.Unlock()
 	return n, nil
 }
@@ -60,25 +46,36 @@ func (wc *BwCounter) AddRate(rate int64) {
 	if rate < 0 {
 		panic("rate < 0 in wc.AddRate")
 	}
-	if wc.rateSum < 0 {
-		panic(fmt.Sprintf("wc.rateSum < 0: %d", wc.rateSum))
+	wc.est.Add(rate)
+	if rate == 0 {
+		wc.idleSamples++
+		return
 	}
-	wc.historyRate = append(wc.historyRate, rate)
-	wc.rateSum += rate
-	if len(wc.historyRate) > maxSampleDepth {
-		wc.rateSum -= wc.historyRate[0]
-		wc.historyRate = wc.historyRate[1:]
+	if wc.delivering {
+		wc.busySamples += wc.idleSamples
 	}
+	wc.busySum += rate
+	wc.busySamples++
+	wc.idleSamples = 0
+	wc.delivering = true
 }
 
 func (wc *BwCounter) Rate() int64 {
 	wc.mux.Lock()
 	defer wc.mux.Unlock()
-	if l := len(wc.historyRate); l == 0 {
+	return wc.est.Rate()
+}
+
+// SustainedRate is the mean of the samples while ranges were delivered, without the wait
+// for their first bytes nor the one after their last: the rate of the path, which Rate,
+// following the last samples, loses to that wait on a short range
+func (wc *BwCounter) SustainedRate() int64 {
+	wc.mux.Lock()
+	defer wc.mux.Unlock()
+	if wc.busySamples == 0 {
 		return 0
-	} else {
-		return wc.rateSum / int64(l)
 	}
+	return wc.busySum / wc.busySamples
 }
 
 // we do not reset rate measurements here: each connection has a counter sharing across requests
@@ -86,29 +83,42 @@ func (wc *BwCounter) Reset() {
 	wc.mux.Lock()
 	defer wc.mux.Unlock()
 	wc.total = 0
+	wc.idleSamples = 0
+	wc.delivering = false
 }
 
 func NewBwCounter(id int) *BwCounter {
 	return &BwCounter{
+		est:    estimators[estimatorName](),
 		connId: id,
 		offset: -1,
 	}
 }
 
+// newBwCounters creates a BwCounter for each of conns, without measurements, waiting
+// for each to be ready: conns[i] is only set then
+func newBwCounters(conns []MonitoredMpConn, connsReady []chan struct{}) []*BwCounter {
+	bw := make([]*BwCounter, len(conns))
+	for i := range bw {
+		<-connsReady[i]
+		bw[i] = NewBwCounter(conns[i].path)
+	}
+	return bw
+}
+
 // DuplicateBwCounter creates new BwCounter that inherits bandwidth measurements but not the progress
 // counters.
 // Useful for passing down bandwidth counters to further jobs.
-func (old *BwCounter) DuplicateBwCounter(id int) (ret *BwCounter) {
+func (old *BwCounter) DuplicateBwCounter(id int) *BwCounter {
 	old.mux.Lock()
 	defer old.mux.Unlock()
-	ret = &BwCounter{
-		historyRate: make([]int64, len(old.historyRate)),
-		rateSum:     old.rateSum,
+	return &BwCounter{
+		est:         old.est.Clone(),
+		busySum:     old.busySum,
+		busySamples: old.busySamples,
 		offset:      -1,
 		connId:      id,
 	}
-	copy(ret.historyRate, old.historyRate)
-	return
 }
 
 func (wc *BwCounter) SetOffset(offset int) {
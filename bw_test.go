@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSustainedRate(t *testing.T) {
+	bw := NewBwCounter(0)
+	// the wait for the first bytes does not count, the gaps between them do
+	for _, sample := range []int64{0, 0, 0, 3000, 0, 3000, 0, 0} {
+		bw.AddRate(sample)
+	}
+	if rate := bw.SustainedRate(); rate != 2000 {
+		t.Errorf("sustained rate = %d, want 2000", rate)
+	}
+	// nor does the wait for the first bytes of the next range
+	next := bw.DuplicateBwCounter(0)
+	for _, sample := range []int64{0, 0, 0, 0, 2000} {
+		next.AddRate(sample)
+	}
+	if rate := next.SustainedRate(); rate != 2000 {
+		t.Errorf("sustained rate over two ranges = %d, want 2000", rate)
+	}
+}
@@ -3,23 +3,100 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"mphttp/dep/http2"
 )
 
+// adaptiveWindow and maxWindow are --adaptivewindow and --maxwindow: the receive
+// windows of the paths sized after their bandwidth-delay product, up to maxWindow bytes
+// (0 for the default of the transport).  pullStreams is --pull: the ranges split across
+// the paths are pulled, see nSplitRequest.
+var (
+	adaptiveWindow bool
+	maxWindow      uint32
+	pullStreams    bool
+)
+
 type MpConn interface {
 	MeasureRtt() time.Duration
 	Close()
 	StartRequest(r *http.Request) responseStream
+	// StartPullRequest starts a stream the server sends only credit bytes of, and what
+	// is granted with http2.ClientStream.Pull later
+	StartPullRequest(r *http.Request, credit int64) responseStream
+	Stats() connStats
+	// TCPInfo reads TCP_INFO from the socket of the connection
+	TCPInfo() (tcpInfo, error)
+	// LocalAddr is the address of the local end, on the interface of the path
+	LocalAddr() net.Addr
+}
+
+// connStats counts what was read on a connection
+type connStats struct {
+	Wire     int64 // bytes read off the connection (after TLS), including HTTP/2 framing
+	Data     int64 // bytes of the DATA frames read: the response bodies, read or not
+	Body     int64 // bytes read from response bodies
+	Resets   int64 // response bodies closed before the server ended them, resetting the stream
+	Failures int64 // requests that failed without a response
+}
+
+// countingConn counts the bytes read from a net.Conn
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countingBody counts the bytes read from a response body, and whether it was closed
+// before the end
+type countingBody struct {
+	io.ReadCloser
+	stats  *connStats
+	length int64 // Content-Length of the response, -1 if unknown
+	read   int64 // set atomically, as Close may come from another goroutine
+	eof    int32 // read to the end; set atomically too
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.stats.Body, int64(n))
+	atomic.AddInt64(&b.read, int64(n))
+	if err == io.EOF {
+		atomic.StoreInt32(&b.eof, 1)
+	}
+	return n, err
+}
+
+// Close counts a reset if the body was not read to its end: a body read up to its length
+// without reading EOF too is not reset
+func (b *countingBody) Close() error {
+	ended := atomic.LoadInt32(&b.eof) == 1 || b.length >= 0 && atomic.LoadInt64(&b.read) >= b.length
+	if !ended {
+		atomic.AddInt64(&b.stats.Resets, 1)
+	}
+	return b.ReadCloser.Close()
 }
 
 type MonitoredMpConn struct {
 	conn MpConn
 	mon  RttMonitor
+	// monitors are all the sampled ones, mon among them
+	monitors []RttMonitor
+	path     int    // index of the server, identifying the path in events
+	key      string // identifies the path in the path cache, see pathKey
 }
 
 type responseStream struct {
@@ -28,77 +105,186 @@ type responseStream struct {
 }
 
 type mpConn struct {
+	stats      connStats // first for 64-bit alignment; updated atomically
 	clientConn *http2.ClientConn
-	tlsConn    *tls.Conn
+	netConn    net.Conn // *tls.Conn, or plain TCP for h2c
+	tcpConn    *net.TCPConn
 	keylogFile *os.File
+	trace      *frameTrace // nil without --qlog
+	scheme     string      // for requests with path-only URLs
+	host       string
 }
 
-func NewMpConn(server string) MpConn {
+// NewMpConn connects to server, which is "host:port" for HTTP/2 over TLS, or
+// "h2c://host:port" for cleartext HTTP/2 with prior knowledge.  The frames go to trace,
+// if not nil.
+func NewMpConn(server string, trace *frameTrace) MpConn {
 	file, err := os.OpenFile("keylog.txt", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	fatal("keylog", err)
 	tr := &http2.Transport{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true,
 			KeyLogWriter:       file,
+			NextProtos:         []string{http2.NextProtoTLS},
 		},
+		AdaptiveWindow:  adaptiveWindow,
+		MaxStreamWindow: maxWindow,
+		MaxConnWindow:   maxWindow,
+		PullStreams:     pullStreams,
 	}
-	conn, err := tls.Dial("tcp", server, tr.TLSClientConfig)
-	fatal("tls dial to "+server, err)
-	clientConn, err := tr.NewClientConn(conn)
-	fatal("http2 conn", err)
-	return &mpConn{
+	if trace != nil {
+		tr.FrameTrace = trace.frame
+	}
+	scheme := "https"
+	h2c := strings.HasPrefix(server, h2cPrefix)
+	if h2c {
+		server = strings.TrimPrefix(server, h2cPrefix)
+		scheme = "http"
+		tr.AllowHTTP = true
+	}
+	tcpConn, err := net.Dial("tcp", server)
+	fatal("dial to "+server, err)
+	conn := tcpConn
+	if !h2c {
+		// as tls.Dial, but keeping the TCP connection for TCP_INFO
+		config := tr.TLSClientConfig.Clone()
+		config.ServerName, _, err = net.SplitHostPort(server)
+		fatal("tls dial to "+server, err)
+		tlsConn := tls.Client(tcpConn, config)
+		fatal("tls dial to "+server, tlsConn.Handshake())
+		conn = tlsConn
+	}
+	c := &mpConn{
 		keylogFile: file,
-		tlsConn:    conn,
-		clientConn: clientConn,
+		trace:      trace,
+		netConn:    conn,
+		tcpConn:    tcpConn.(*net.TCPConn),
+		scheme:     scheme,
+		host:       server,
 	}
+	c.clientConn, err = tr.NewClientConn(countingConn{Conn: conn, n: &c.stats.Wire})
+	fatal("http2 conn", err)
+	return c
 }
 
-func NewMonitoredMpConn(server string) MonitoredMpConn {
-	conn := NewMpConn(server)
-	mon := NewRttMonitor(conn)
-	mon.Start()
+func NewMonitoredMpConn(server string, path int) MonitoredMpConn {
+	start := time.Now()
+	trace, err := createFrameTrace(path, server)
+	fatal("frame trace", err)
+	conn := NewMpConn(server, trace)
+	logEvent("connect", path, eventFields{"server": server, "handshake": msec(time.Since(start))})
+	key := pathKey(server, conn.LocalAddr())
+	ping := NewRttMonitor(conn, path, key)
+	ping.Start()
+	mon, monitors := ping, []RttMonitor{ping}
+	// the kernel is only asked when its RTT is used, or logged to compare both sources
+	if rttSource == "tcpinfo" || events != nil || report != nil {
+		kernel := newTCPInfoMonitor(conn, path)
+		kernel.Start()
+		monitors = append(monitors, kernel)
+		if rttSource == "tcpinfo" {
+			mon = kernel
+		}
+	}
 	return MonitoredMpConn{
-		conn: conn,
-		mon:  mon,
+		conn:     conn,
+		mon:      mon,
+		monitors: monitors,
+		path:     path,
+		key:      key,
 	}
 }
 
 func (c *mpConn) StartRequest(r *http.Request) responseStream {
-	resp, cs, err := c.clientConn.RoundTrip(r)
+	return c.startRequest(r, -1)
+}
+
+func (c *mpConn) StartPullRequest(r *http.Request, credit int64) responseStream {
+	return c.startRequest(r, credit)
+}
+
+// startRequest pulls the stream with credit bytes to start with, if credit >= 0
+func (c *mpConn) startRequest(r *http.Request, credit int64) responseStream {
+	if r.URL.Host == "" {
+		// path-only URLs go to the server of this connection
+		r = r.Clone(r.Context())
+		r.URL.Scheme, r.URL.Host = c.scheme, c.host
+	}
+	var resp *http.Response
+	var cs *http2.ClientStream
+	var err error
+	if credit < 0 {
+		resp, cs, err = c.clientConn.RoundTrip(r)
+	} else {
+		resp, cs, err = c.clientConn.RoundTripPull(r, credit)
+	}
 	if err != nil {
 		log.Print("response in StartRequest: ", err)
+		atomic.AddInt64(&c.stats.Failures, 1)
 		return responseStream{}
 	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, stats: &c.stats, length: resp.ContentLength}
 	return responseStream{
 		response: resp,
 		stream:   cs,
 	}
 }
 
+func (c *mpConn) Stats() connStats {
+	return connStats{
+		Wire:     atomic.LoadInt64(&c.stats.Wire),
+		Data:     c.clientConn.Stats().DataRead,
+		Body:     atomic.LoadInt64(&c.stats.Body),
+		Resets:   atomic.LoadInt64(&c.stats.Resets),
+		Failures: atomic.LoadInt64(&c.stats.Failures),
+	}
+}
+
+func (c *mpConn) TCPInfo() (tcpInfo, error) {
+	return readTCPInfo(c.tcpConn)
+}
+
+func (c *mpConn) LocalAddr() net.Addr {
+	return c.tcpConn.LocalAddr()
+}
+
+// MeasureRtt sends a PING and returns the RTT the transport measured on its ACK, or
+// on a later PING of the window estimation
 func (c *mpConn) MeasureRtt() time.Duration {
-	start := time.Now()
 	err := c.clientConn.Ping(context.Background())
 	if err != nil {
 		//log.Print("ping: ", err)
 		return 0
 	}
-	return time.Since(start)
+	return c.clientConn.Stats().RTT
 }
 
 func (c *mpConn) Close() {
 	c.clientConn.Close()
-	c.tlsConn.Close()
+	c.netConn.Close()
 	c.keylogFile.Close()
+	fatal("frame trace", c.trace.Close())
 }
 
 func (c MonitoredMpConn) StartRequest(r *http.Request) responseStream {
 	return c.conn.StartRequest(r)
 }
 
+func (c MonitoredMpConn) StartPullRequest(r *http.Request, credit int64) responseStream {
+	return c.conn.StartPullRequest(r, credit)
+}
+
 func (c MonitoredMpConn) MeasureRtt() time.Duration {
 	return c.mon.GetRtt()
 }
 
+func (c MonitoredMpConn) Stats() connStats {
+	return c.conn.Stats()
+}
+
 func (c MonitoredMpConn) Close() {
+	for _, mon := range c.monitors {
+		mon.Stop()
+	}
 	c.conn.Close()
 }
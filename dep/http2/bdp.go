@@ -0,0 +1,87 @@
+package http2
+
+import "time"
+
+// The bandwidth-delay product estimation of Transport.AdaptiveWindow, after
+// the one of gRPC: a PING is sent with a DATA frame, and the bytes received
+// until its ack are a sample of the BDP.  When a sample comes close to the
+// estimate, at the highest bandwidth seen, the window is what limits the
+// transfer, and the estimate is doubled.
+const (
+	// adaptiveWindowMax is the default cap of the windows grown with
+	// Transport.AdaptiveWindow.
+	adaptiveWindowMax = 16 << 20
+
+	bdpAlpha = 0.9  // weight of a new sample in the smoothed RTT
+	bdpBeta  = 0.66 // part of the estimate a sample must reach to grow it
+	bdpGamma = 2    // growth of the estimate over the sample
+)
+
+// bdpPing is the payload of the PING frames of the estimation, told apart
+// from the random ones of ClientConn.Ping.
+var bdpPing = [8]byte{'m', 'p', 'h', 't', 't', 'p', 'b', 'd'}
+
+// bdpEstimator estimates the bandwidth-delay product of a connection.  It is
+// owned by the read loop.
+type bdpEstimator struct {
+	bdp         uint32 // current estimate
+	limit       uint32 // estimate past which there is no point estimating
+	sample      uint32 // bytes received since the PING was sent
+	sampling    bool   // a PING is in flight
+	sentAt      time.Time
+	sampleCount int
+	rtt         float64 // smoothed, in seconds
+	bwMax       float64 // highest bandwidth sampled, in bytes per second
+}
+
+// add counts n bytes of DATA received, and reports whether a PING is to be
+// sent to start a sample, followed by a call to sent.
+func (b *bdpEstimator) add(n uint32) bool {
+	if b.bdp >= b.limit {
+		return false
+	}
+	if !b.sampling {
+		b.sampling = true
+		b.sample = n
+		b.sentAt = time.Time{}
+		b.sampleCount++
+		return true
+	}
+	b.sample += n
+	return false
+}
+
+// sent records the time the PING of the sample was written.
+func (b *bdpEstimator) sent() {
+	b.sentAt = time.Now()
+}
+
+// calculate ends the sample on the ack of its PING, and returns the grown
+// estimate, or 0 if it did not grow.
+func (b *bdpEstimator) calculate() uint32 {
+	if b.sentAt.IsZero() {
+		return 0
+	}
+	b.sampling = false
+	rtt := time.Since(b.sentAt).Seconds()
+	if b.sampleCount < 10 {
+		// the first samples weigh the same
+		b.rtt += (rtt - b.rtt) / float64(b.sampleCount)
+	} else {
+		b.rtt += (rtt - b.rtt) * bdpAlpha
+	}
+	// the sample spans more than an RTT: from the PING to its ack, and the
+	// DATA frames in flight when the PING went
+	bw := float64(b.sample) / (b.rtt * 1.5)
+	if bw > b.bwMax {
+		b.bwMax = bw
+	}
+	if float64(b.sample) < bdpBeta*float64(b.bdp) || bw < b.bwMax {
+		return 0
+	}
+	b.bdp = uint32(bdpGamma * float64(b.sample))
+	if b.bdp > b.limit {
+		b.bdp = b.limit
+	}
+	return b.bdp
+}
@@ -42,6 +42,13 @@ func (p *pipe) Len() int {
 // Read waits until data is available and copies bytes
 // from the buffer into p.
 func (p *pipe) Read(d []byte) (n int, err error) {
+	return p.readUpTo(d, nil)
+}
+
+// readUpTo is Read copying no more than max bytes, if max is not nil.
+// max is called with p.mu held once data is available, so that a limit
+// moved while waiting for it is respected; it may return 0.
+func (p *pipe) readUpTo(d []byte, max func() int) (n int, err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if p.c.L == nil {
@@ -52,6 +59,11 @@ func (p *pipe) Read(d []byte) (n int, err error) {
 			return 0, p.breakErr
 		}
 		if p.b != nil && p.b.Len() > 0 {
+			if max != nil {
+				if m := max(); len(d) > m {
+					d = d[:m]
+				}
+			}
 			return p.b.Read(d)
 		}
 		if p.err != nil {
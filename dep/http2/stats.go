@@ -0,0 +1,101 @@
+package http2
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a snapshot of the state of a ClientConn, see ClientConn.Stats.
+type ConnStats struct {
+	RTT        time.Duration // of the last PING acknowledged, sent by Ping or the BDP estimation; 0 before
+	BytesRead  int64         // bytes of the frames read, frame headers included
+	DataRead   int64         // bytes of the DATA frames read, padding included, of reset streams too
+	FramesRead int64
+
+	ActiveStreams   int // streams open, or reset by the client but not forgotten
+	PendingRequests int // requests waiting for a stream slot
+
+	ConnInflow   int32 // connection window left to the server
+	ConnWindow   int32 // connection window kept open, grown with Transport.AdaptiveWindow
+	StreamWindow int32 // stream window kept open, grown with Transport.AdaptiveWindow
+	ConnOutflow  int32 // connection window the server left to the client
+
+	// the SETTINGS of the server
+	PeerMaxConcurrentStreams uint32
+	PeerMaxFrameSize         uint32
+	PeerInitialWindowSize    uint32
+	PeerMaxHeaderListSize    uint64
+	WaitingSettingsAck       bool // the SETTINGS of the client are not acknowledged yet
+	GoAway                   bool // the server sent a GOAWAY
+	GoAwayCode               ErrCode
+	GoAwayLastStreamID       uint32
+	Closed                   bool
+}
+
+// Stats returns a snapshot of the state of the connection.
+func (cc *ClientConn) Stats() ConnStats {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	s := ConnStats{
+		RTT:                      cc.rtt,
+		BytesRead:                atomic.LoadInt64(&cc.bytesRead),
+		DataRead:                 atomic.LoadInt64(&cc.dataRead),
+		FramesRead:               atomic.LoadInt64(&cc.framesRead),
+		ActiveStreams:            len(cc.streams),
+		PendingRequests:          cc.pendingRequests,
+		ConnInflow:               cc.inflow.available(),
+		ConnWindow:               cc.connWindow,
+		StreamWindow:             cc.streamWindow,
+		ConnOutflow:              cc.flow.available(),
+		PeerMaxConcurrentStreams: cc.maxConcurrentStreams,
+		PeerMaxFrameSize:         cc.maxFrameSize,
+		PeerInitialWindowSize:    cc.initialWindowSize,
+		PeerMaxHeaderListSize:    cc.peerMaxHeaderListSize,
+		WaitingSettingsAck:       cc.wantSettingsAck,
+		Closed:                   cc.closed,
+	}
+	if cc.goAway != nil {
+		s.GoAway = true
+		s.GoAwayCode = cc.goAway.ErrCode
+		s.GoAwayLastStreamID = cc.goAway.LastStreamID
+	}
+	return s
+}
+
+// StreamStats is a snapshot of the state of a ClientStream, see
+// ClientStream.Stats.
+type StreamStats struct {
+	Received   int64 // bytes of the body received, not counting what came after a reset
+	Delivered  int64 // bytes of the body read
+	Buffered   int   // bytes of the body received but not read yet
+	Inflow     int32 // stream window left to the server
+	TokensSent int64 // stream window granted to the server since the stream started
+	ChokeAt    int64 // see ChokeAt; 0 if not choked
+	Pull       bool  // in pull mode, see Pull
+	Reset      bool  // reset by the client
+
+	// TimeToFirstByte is the time from the HEADERS of the request written to
+	// the first byte of the body received; 0 before.
+	TimeToFirstByte time.Duration
+}
+
+// Stats returns a snapshot of the state of the stream.
+func (cs *ClientStream) Stats() StreamStats {
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	s := StreamStats{
+		Received:   cs.received,
+		Delivered:  cs.delivered,
+		Buffered:   cs.bufPipe.Len(),
+		Inflow:     cs.inflow.n,
+		TokensSent: cs.tokensSent,
+		ChokeAt:    cs.chokeAt,
+		Pull:       cs.pull,
+		Reset:      cs.didReset,
+	}
+	if !cs.firstDataAt.IsZero() {
+		s.TimeToFirstByte = cs.firstDataAt.Sub(cs.sentAt)
+	}
+	return s
+}
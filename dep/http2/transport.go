@@ -108,6 +108,31 @@ type Transport struct {
 	// waiting for their turn.
 	StrictMaxConcurrentStreams bool
 
+	// FrameTrace, if non-nil, is called with the DATA frames read and the
+	// WINDOW_UPDATE, PING, RST_STREAM and GOAWAY frames read or written by
+	// the connections of the Transport. It is called with the connection
+	// locked, so it must return quickly and must not use the connection.
+	FrameTrace func(FrameEvent)
+
+	// AdaptiveWindow, if true, makes the connections size their receive
+	// windows after the bandwidth-delay product of the path, estimated from
+	// PING round trips and the bytes received meanwhile, rather than giving
+	// the server 4MB per stream and 1GB per connection.  The windows start at
+	// the 64KB default of the protocol and grow up to MaxStreamWindow and
+	// MaxConnWindow.
+	AdaptiveWindow bool
+
+	// MaxStreamWindow and MaxConnWindow cap the receive windows of a stream
+	// and of a connection grown with AdaptiveWindow.  Zero means 16MB.
+	MaxStreamWindow uint32
+	MaxConnWindow   uint32
+
+	// PullStreams, if true, lets ClientConn.RoundTripPull start streams with
+	// no window at all: the connections announce a stream window of 0 in
+	// their SETTINGS, and the other streams get theirs with a WINDOW_UPDATE
+	// following their HEADERS.
+	PullStreams bool
+
 	// t1, if non-nil, is the standard library Transport using
 	// this transport. Its settings are used (but not its
 	// RoundTrip method, etc).
@@ -127,6 +152,42 @@ func (t *Transport) maxHeaderListSize() uint32 {
 	return t.MaxHeaderListSize
 }
 
+// initialStreamWindow is the receive window of the streams announced in the
+// SETTINGS of the connections.
+func (t *Transport) initialStreamWindow() int32 {
+	if t.PullStreams {
+		return 0
+	}
+	return t.streamWindow()
+}
+
+// streamWindow is the receive window the streams start with, opened again as
+// their body is read.
+func (t *Transport) streamWindow() int32 {
+	if t.AdaptiveWindow {
+		return initialWindowSize
+	}
+	return transportDefaultStreamFlow
+}
+
+func (t *Transport) maxStreamWindow() int32 {
+	return windowCap(t.MaxStreamWindow)
+}
+
+func (t *Transport) maxConnWindow() int32 {
+	return windowCap(t.MaxConnWindow)
+}
+
+func windowCap(max uint32) int32 {
+	switch {
+	case max == 0:
+		return adaptiveWindowMax
+	case max > 1<<31-1:
+		return 1<<31 - 1
+	}
+	return int32(max)
+}
+
 func (t *Transport) disableCompression() bool {
 	return t.DisableCompression || (t.t1 != nil && t.t1.DisableCompression)
 }
@@ -197,6 +258,12 @@ func (t *Transport) initConnPool() {
 // ClientConn is the state of a single HTTP/2 client connection to an
 // HTTP/2 server.
 type ClientConn struct {
+	// counters of the frames read, see ConnStats; atomic, as the read loop
+	// updates them on every frame.  First, to be 64-bit aligned.
+	bytesRead  int64
+	dataRead   int64
+	framesRead int64
+
 	t         *Transport
 	tconn     net.Conn             // usually *tls.Conn, except specialized impls
 	tlsState  *tls.ConnectionState // nil only for specialized impls
@@ -223,6 +290,10 @@ type ClientConn struct {
 	nextStreamID    uint32
 	pendingRequests int                       // requests blocked and waiting to be sent because len(streams) == maxConcurrentStreams
 	pings           map[[8]byte]chan struct{} // in flight ping data to notification channel
+	streamWindow    int32                     // receive window kept open for each stream
+	connWindow      int32                     // receive window kept open for the connection
+	bdp             *bdpEstimator             // nil unless Transport.AdaptiveWindow; owned by the read loop
+	rtt             time.Duration             // of the last PING acknowledged
 	bw              *bufio.Writer
 	br              *bufio.Reader
 	fr              *Framer
@@ -258,13 +329,19 @@ type ClientStream struct {
 	flow        flow  // guarded by cc.mu
 	inflow      flow  // guarded by cc.mu
 	bytesRemain int64 // -1 means unknown; owned by transportResponseBody.Read
-	bytesTotal  int64 // ContentLength of the request, used to calculate new bytesRemain in ChokeAt
-	tokensSent  int64 // number of tokens sent to remote since stream start
-	choked      bool  // if choked; the stream will be choked at ChokeAt bytes
+	bytesTotal  int64 // ContentLength of the response, the furthest ChokeAt can go; -1 means unknown
+	tokensSent  int64 // number of tokens sent to remote since stream start; guarded by cc.mu
+	chokeAt     int64 // if > 0, the body ends after this many bytes, see ChokeAt; guarded by cc.mu, and written with bufPipe.mu held too
+	pull        bool  // the window is opened by Pull only, not as the body is read; guarded by cc.mu
+	received    int64 // bytes of the body received from the server; guarded by cc.mu
+	delivered   int64 // bytes of the body returned by Read; guarded by cc.mu
 	readErr     error // sticky read error; owned by transportResponseBody.Read
 	stopReqBody error // if non-nil, stop writing req body; guarded by cc.mu
 	didReset    bool  // whether we sent a RST_STREAM to the server; guarded by cc.mu
 
+	sentAt      time.Time // when the HEADERS were written; guarded by cc.mu
+	firstDataAt time.Time // when the first byte of the body was received; guarded by cc.mu
+
 	peerReset chan struct{} // closed on peer reset
 	resetErr  error         // populated before peerReset is closed
 
@@ -298,30 +375,289 @@ func awaitRequestCancel(req *http.Request, done <-chan struct{}) error {
 	}
 }
 
-// ChokeAt sets the choke threshold for the client stream.  Calling this results in the last WINDOW_UPATE frame
-// being sent.  The window will then never update and will deplete when exactly bytes specified has been received.
-func (cs *ClientStream) ChokeAt(bytes int64) {
-	if cs.choked {
-		panic("ChokeAt has already been called on this stream")
-	}
+// ErrChokeTooLate is returned by ChokeAt for a choke point that the body has
+// already been read past.
+var ErrChokeTooLate = errors.New("http2: choke point already delivered")
+
+var (
+	errChokeNotPositive = errors.New("http2: ChokeAt with bytes <= 0")
+	errChokeBeyondBody  = errors.New("http2: ChokeAt beyond the Content-Length of the response")
+	errPullNotPositive  = errors.New("http2: Pull with n <= 0")
+)
+
+// ChokedError is returned by the body of a stream choked with ChokeAt once
+// the choke point is reached.
+type ChokedError struct {
+	Delivered int64 // bytes of the body read, which is the choke point
+}
+
+func (e ChokedError) Error() string {
+	return fmt.Sprintf("http2: stream choked after %d bytes", e.Delivered)
+}
+
+// ChokeAt makes the response body end after its first bytes bytes, with a
+// ChokedError instead of io.EOF.  The window of the stream is refreshed as
+// the body is read up to bytes and no further, so that the server sends no more
+// than that unless it was granted more before: the surplus is then discarded.
+//
+// Once the server has sent up to the choke point, the stream is reset with
+// RST_STREAM(CANCEL), and Done is closed: the rest of the body is not wanted.
+// The body can still be read up to the choke point.
+//
+// ChokeAt may be called again while the body is read, to move the choke point
+// earlier, or later with a WINDOW_UPDATE for the additional credit; calling it
+// with the current choke point does nothing.  Choking at the Content-Length of
+// the response lifts the choke.  It fails with ErrChokeTooLate for a choke
+// point that the body has been read past, or past the end of a stream already
+// reset.  In pull mode, see Pull, the window is opened by Pull alone, up to
+// the choke point.
+func (cs *ClientStream) ChokeAt(bytes int64) error {
 	if bytes <= 0 {
-		panic("ChokeAt invoked with bytes<=0")
+		return errChokeNotPositive
+	}
+	if cs.bytesTotal != -1 && bytes > cs.bytesTotal {
+		return errChokeBeyondBody
 	}
-	// calculate how much WINDOW_UPDATE needed
-	remaining := bytes - cs.tokensSent
-	if remaining > 0 { // or the stream would have closed
-		// the stream was not finished yet
-		cc := cs.cc
+	cc := cs.cc
+	cc.mu.Lock()
+	err := cs.chokeAtLocked(bytes)
+	reset := err == nil && cs.resetChokedLocked()
+	cc.mu.Unlock()
+	if reset {
+		cs.endChoked()
+	}
+	return err
+}
+
+func (cs *ClientStream) chokeAtLocked(bytes int64) error {
+	cc := cs.cc
+	if bytes == cs.chokeAt {
+		return nil
+	}
+	if bytes < cs.delivered || cs.didReset && (cs.chokeAt == 0 || bytes > cs.chokeAt) {
+		return ErrChokeTooLate
+	}
+	if bytes == cs.bytesTotal {
+		// the server ends the stream there anyway
+		bytes = 0
+	}
+	// a Read waiting for data copies up to the choke point it finds then, see
+	// transportResponseBody.Read
+	cs.bufPipe.mu.Lock()
+	cs.chokeAt = bytes
+	cs.bufPipe.mu.Unlock()
+	// a window held back by an earlier choke point opens up to the new one
+	if streamAdd := cs.refreshWindowLocked(); streamAdd != 0 {
 		cc.wmu.Lock()
 		defer cc.wmu.Unlock()
-		cs.choked = true
-		cs.inflow.add(int32(remaining))
-		cc.fr.WriteWindowUpdate(cs.ID, uint32(remaining))
+		cc.fr.WriteWindowUpdate(cs.ID, uint32(streamAdd))
+		cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, StreamID: cs.ID, Increment: uint32(streamAdd)}, cs)
+		cc.bw.Flush()
 	}
-	// decrease bytesRemain so that when receiving the stream will be truncated and closed
-	cs.bytesRemain -= cs.bytesTotal - bytes + 1
-	//fmt.Printf("ChokeAt %d: bytesRemain=%d, remaining=%d tokenSent=%d\n",
-	//	bytes, cs.bytesRemain, remaining, cs.tokensSent)
+	return nil
+}
+
+// resetChokedLocked reports whether the stream is to be reset with
+// endChoked, the server having sent it up to the choke point.  It requires
+// cc.mu be held.
+func (cs *ClientStream) resetChokedLocked() bool {
+	if cs.chokeAt == 0 || cs.received < cs.chokeAt || cs.didReset {
+		return false
+	}
+	cs.didReset = true
+	return true
+}
+
+// endChoked resets the stream, leaving what was received up to the choke
+// point to be read from the body, which ends there.
+func (cs *ClientStream) endChoked() {
+	cs.cc.writeStreamReset(cs.ID, ErrCodeCancel, nil)
+	cs.cc.forgetStreamID(cs.ID)
+}
+
+// Pull grants the server n more bytes of the body in a WINDOW_UPDATE, and
+// switches the stream to pull mode, if it is not already: its window is no
+// longer opened as the body is read, so that the server sends the body only
+// as far as it was pulled.  Pulling at the pace of the reader throttles the
+// stream, not pulling pauses it, and ChokeAt still ends it.
+//
+// Pull returns how many bytes were granted, fewer than n past the choke point
+// or the end of the body, and none once the stream is over.
+func (cs *ClientStream) Pull(n int64) (int64, error) {
+	if n <= 0 {
+		return 0, errPullNotPositive
+	}
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cs.pull = true
+	if cs.didReset || cs.bufPipe.Err() != nil {
+		return 0, nil
+	}
+	if cs.bytesTotal != -1 && cs.tokensSent+n > cs.bytesTotal {
+		n = cs.bytesTotal - cs.tokensSent
+	}
+	if cs.chokeAt > 0 && cs.tokensSent+n > cs.chokeAt {
+		n = cs.chokeAt - cs.tokensSent
+	}
+	if max := int64(1<<31-1) - int64(cs.inflow.n); n > max {
+		n = max
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	cs.inflow.add(int32(n))
+	cs.tokensSent += n
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.fr.WriteWindowUpdate(cs.ID, uint32(n))
+	cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, StreamID: cs.ID, Increment: uint32(n)}, cs)
+	return n, cc.bw.Flush()
+}
+
+// Unpull leaves pull mode: the window of the stream is opened again as the
+// body is read.
+func (cs *ClientStream) Unpull() error {
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cs.pull {
+		return nil
+	}
+	cs.pull = false
+	if cs.didReset || cs.bufPipe.Err() != nil {
+		return nil
+	}
+	if streamAdd := cs.refreshWindowLocked(); streamAdd != 0 {
+		cc.wmu.Lock()
+		defer cc.wmu.Unlock()
+		cc.fr.WriteWindowUpdate(cs.ID, uint32(streamAdd))
+		cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, StreamID: cs.ID, Increment: uint32(streamAdd)}, cs)
+		return cc.bw.Flush()
+	}
+	return nil
+}
+
+// Done is closed once the stream is over on the connection: ended by the
+// server, reset by either side, or forgotten when the body was closed.  What
+// was received may remain to be read from the body.
+func (cs *ClientStream) Done() <-chan struct{} {
+	return cs.done
+}
+
+// refreshWindowLocked takes the stream window back to cc.streamWindow once it
+// is low enough, but not past the choke point, and returns the increment to
+// send in a WINDOW_UPDATE, if any, none in pull mode.  It requires cc.mu be
+// held.
+func (cs *ClientStream) refreshWindowLocked() int32 {
+	if cs.pull {
+		return 0
+	}
+	// Consider any buffered body data (read from the conn but not
+	// consumed by the client) when computing flow control for this
+	// stream.  The window of the connection, which may be the smaller
+	// one with Transport.AdaptiveWindow, is not this stream's concern.
+	v := int(cs.inflow.n) + cs.bufPipe.Len()
+	window := int(cs.cc.streamWindow)
+	if v >= window-transportDefaultStreamMinRefresh {
+		return 0
+	}
+	add := int64(window - v)
+	if cs.chokeAt > 0 && cs.tokensSent+add > cs.chokeAt {
+		add = cs.chokeAt - cs.tokensSent
+	}
+	if add <= 0 {
+		return 0
+	}
+	cs.inflow.add(int32(add))
+	cs.tokensSent += add
+	return int32(add)
+}
+
+// FrameEvent is a frame read or written by a ClientConn, as passed to
+// Transport.FrameTrace, with the flow control state of the receiving side of
+// the client after the frame.
+type FrameEvent struct {
+	Time         time.Time
+	Sent         bool // written by the client; read otherwise
+	Type         FrameType
+	Flags        Flags
+	StreamID     uint32
+	Length       uint32  // payload length, including padding
+	Increment    uint32  // WINDOW_UPDATE only
+	ErrCode      ErrCode // RST_STREAM and GOAWAY only
+	LastStreamID uint32  // GOAWAY only
+
+	ConnInflow int32 // connection window left to the server
+
+	// Stream state, if the frame is on a stream of the client:
+	StreamInflow int32 // stream window left to the server
+	TokensSent   int64 // stream window granted since the stream started
+	ChokeAt      int64 // choke point of the stream, 0 if not choked
+	Delivered    int64 // bytes of the body read
+}
+
+// tracedFrame reports whether frames of type t go to Transport.FrameTrace.
+func tracedFrame(t FrameType, sent bool) bool {
+	switch t {
+	case FrameData:
+		return !sent
+	case FrameWindowUpdate, FramePing, FrameRSTStream, FrameGoAway:
+		return true
+	}
+	return false
+}
+
+// frameEvent describes f, read by the client.
+func frameEvent(f Frame) FrameEvent {
+	h := f.Header()
+	ev := FrameEvent{Type: h.Type, Flags: h.Flags, StreamID: h.StreamID, Length: h.Length}
+	switch f := f.(type) {
+	case *WindowUpdateFrame:
+		ev.Increment = f.Increment
+	case *RSTStreamFrame:
+		ev.ErrCode = f.ErrCode
+	case *GoAwayFrame:
+		ev.ErrCode = f.ErrCode
+		ev.LastStreamID = f.LastStreamID
+	}
+	return ev
+}
+
+// traceFrame passes ev to the FrameTrace of the Transport, if any, with the
+// flow control state of cc and of cs, the stream of the frame (or nil).
+func (cc *ClientConn) traceFrame(ev FrameEvent, cs *ClientStream) {
+	if cc.t.FrameTrace == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.traceFrameLocked(ev, cs)
+}
+
+// traceFrameLocked is traceFrame with cc.mu held.
+func (cc *ClientConn) traceFrameLocked(ev FrameEvent, cs *ClientStream) {
+	if cc.t.FrameTrace == nil || !tracedFrame(ev.Type, ev.Sent) {
+		return
+	}
+	ev.Time = time.Now()
+	if ev.Sent {
+		// the frames traced as written have a fixed length
+		switch ev.Type {
+		case FrameWindowUpdate, FrameRSTStream:
+			ev.Length = 4
+		case FramePing, FrameGoAway:
+			ev.Length = 8
+		}
+	}
+	ev.ConnInflow = cc.inflow.available()
+	if cs != nil {
+		ev.StreamInflow = cs.inflow.n
+		ev.TokensSent = cs.tokensSent
+		ev.ChokeAt = cs.chokeAt
+		ev.Delivered = cs.delivered
+	}
+	cc.t.FrameTrace(ev)
 }
 
 var got1xxFuncForTests func(int, textproto.MIMEHeader) error
@@ -474,7 +810,7 @@ func (t *Transport) RoundTripOpt(req *http.Request, opt RoundTripOpt) (*http.Res
 		}
 		reused := !atomic.CompareAndSwapUint32(&cc.reused, 0, 1)
 		traceGotConn(req, cc, reused)
-		res, gotErrAfterReqBodyWrite, _, err := cc.roundTrip(req)
+		res, gotErrAfterReqBodyWrite, _, err := cc.roundTrip(req, -1)
 		if err != nil && retry <= 6 {
 			if req, err = shouldRetryRequest(req, err, gotErrAfterReqBodyWrite); err == nil {
 				// After the first retry, do exponential backoff with 10% jitter.
@@ -683,9 +1019,19 @@ func (t *Transport) newClientConn(c net.Conn, singleUse bool) (*ClientConn, erro
 		cc.tlsState = &state
 	}
 
+	cc.streamWindow = t.streamWindow()
+	cc.connWindow = transportDefaultConnFlow
+	if t.AdaptiveWindow {
+		cc.connWindow = initialWindowSize
+		cc.bdp = &bdpEstimator{bdp: initialWindowSize, limit: uint32(t.maxStreamWindow())}
+		if max := t.maxConnWindow(); max > t.maxStreamWindow() {
+			cc.bdp.limit = uint32(max)
+		}
+	}
+
 	initialSettings := []Setting{
 		{ID: SettingEnablePush, Val: 0},
-		{ID: SettingInitialWindowSize, Val: transportDefaultStreamFlow},
+		{ID: SettingInitialWindowSize, Val: uint32(t.initialStreamWindow())},
 	}
 	if max := t.maxHeaderListSize(); max != 0 {
 		initialSettings = append(initialSettings, Setting{ID: SettingMaxHeaderListSize, Val: max})
@@ -693,8 +1039,12 @@ func (t *Transport) newClientConn(c net.Conn, singleUse bool) (*ClientConn, erro
 
 	cc.bw.Write(clientPreface)
 	cc.fr.WriteSettings(initialSettings...)
-	cc.fr.WriteWindowUpdate(0, transportDefaultConnFlow)
-	cc.inflow.add(transportDefaultConnFlow + initialWindowSize)
+	cc.inflow.add(initialWindowSize)
+	if !t.AdaptiveWindow {
+		cc.fr.WriteWindowUpdate(0, transportDefaultConnFlow)
+		cc.inflow.add(transportDefaultConnFlow)
+		cc.traceFrame(FrameEvent{Sent: true, Type: FrameWindowUpdate, Increment: transportDefaultConnFlow}, nil)
+	}
 	cc.bw.Flush()
 	if cc.werr != nil {
 		return nil, cc.werr
@@ -867,6 +1217,7 @@ func (cc *ClientConn) sendGoAway() error {
 	if err := cc.fr.WriteGoAway(maxStreamID, ErrCodeNo, nil); err != nil {
 		return err
 	}
+	cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameGoAway, ErrCode: ErrCodeNo, LastStreamID: maxStreamID}, nil)
 	if err := cc.bw.Flush(); err != nil {
 		return err
 	}
@@ -997,11 +1348,27 @@ func actualContentLength(req *http.Request) int64 {
 }
 
 func (cc *ClientConn) RoundTrip(req *http.Request) (*http.Response, *ClientStream, error) {
-	resp, _, cs, err := cc.roundTrip(req)
+	resp, _, cs, err := cc.roundTrip(req, -1)
 	return resp, cs, err
 }
 
-func (cc *ClientConn) roundTrip(req *http.Request) (res *http.Response, gotErrAfterReqBodyWrite bool, cs *ClientStream, err error) {
+// RoundTripPull is RoundTrip for a stream in pull mode from the start, see
+// ClientStream.Pull: the server may send credit bytes of the body, granted
+// with the HEADERS, beyond the window announced in the SETTINGS of the
+// connection, which is none with Transport.PullStreams.
+func (cc *ClientConn) RoundTripPull(req *http.Request, credit int64) (*http.Response, *ClientStream, error) {
+	if credit < 0 || credit > 1<<31-1-int64(cc.t.initialStreamWindow()) {
+		return nil, nil, errPullCredit
+	}
+	resp, _, cs, err := cc.roundTrip(req, credit)
+	return resp, cs, err
+}
+
+var errPullCredit = errors.New("http2: RoundTripPull credit out of the range of a window")
+
+// roundTrip starts the stream in pull mode with credit bytes of window if
+// credit >= 0.
+func (cc *ClientConn) roundTrip(req *http.Request, credit int64) (res *http.Response, gotErrAfterReqBodyWrite bool, cs *ClientStream, err error) {
 	if err := checkConnHeaders(req); err != nil {
 		return nil, false, nil, err
 	}
@@ -1059,12 +1426,31 @@ func (cc *ClientConn) roundTrip(req *http.Request) (res *http.Response, gotErrAf
 	cs.req = req
 	cs.trace = httptrace.ContextClientTrace(req.Context())
 	cs.requestedGzip = requestedGzip
+	if credit >= 0 {
+		cs.pull = true
+		cs.inflow.add(int32(credit))
+		cs.tokensSent += credit
+	}
 	bodyWriter := cc.t.getBodyWriterState(cs, body)
 	cs.on100 = bodyWriter.on100
 
 	cc.wmu.Lock()
 	endStream := !hasBody && !hasTrailers
 	werr := cc.writeHeaders(cs.ID, endStream, int(cc.maxFrameSize), hdrs)
+	cs.sentAt = time.Now()
+	if werr == nil {
+		// the window grown past the SETTINGS of the connection, or the credit
+		// of a pulled stream
+		streamAdd := cs.refreshWindowLocked()
+		if cs.pull {
+			streamAdd = int32(credit)
+		}
+		if streamAdd != 0 {
+			cc.fr.WriteWindowUpdate(cs.ID, uint32(streamAdd))
+			cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, StreamID: cs.ID, Increment: uint32(streamAdd)}, cs)
+			werr = cc.bw.Flush()
+		}
+	}
 	cc.wmu.Unlock()
 	traceWroteHeaders(cs.trace)
 	cc.mu.Unlock()
@@ -1660,9 +2046,9 @@ func (cc *ClientConn) newStream() *ClientStream {
 	}
 	cs.flow.add(int32(cc.initialWindowSize))
 	cs.flow.setConnFlow(&cc.flow)
-	cs.inflow.add(transportDefaultStreamFlow)
+	cs.inflow.add(cc.t.initialStreamWindow())
 	cs.inflow.setConnFlow(&cc.inflow)
-	cs.tokensSent = transportDefaultStreamFlow
+	cs.tokensSent = int64(cc.t.initialStreamWindow())
 	cc.nextStreamID += 2
 	cc.streams[cs.ID] = cs
 	return cs
@@ -1706,6 +2092,7 @@ func (cc *ClientConn) readLoop() {
 		cc.wmu.Lock()
 		cc.fr.WriteGoAway(0, ErrCode(ce), nil)
 		cc.wmu.Unlock()
+		cc.traceFrame(FrameEvent{Sent: true, Type: FrameGoAway, ErrCode: ErrCode(ce)}, nil)
 	}
 }
 
@@ -1790,6 +2177,8 @@ func (rl *clientConnReadLoop) run() error {
 		} else if err != nil {
 			return err
 		}
+		atomic.AddInt64(&cc.framesRead, 1)
+		atomic.AddInt64(&cc.bytesRead, int64(frameHeaderLen+f.Header().Length))
 		if VerboseLogs {
 			cc.vlogf("http2: Transport received %s", summarizeFrame(f))
 		}
@@ -1802,6 +2191,14 @@ func (rl *clientConnReadLoop) run() error {
 		}
 		maybeIdle := false // whether frame might transition us to idle
 
+		// the stream of a traced frame, looked up before processing
+		// may forget it
+		var tracedStream *ClientStream
+		traced := cc.t.FrameTrace != nil && tracedFrame(f.Header().Type, false)
+		if traced && f.Header().StreamID != 0 {
+			tracedStream = cc.streamByID(f.Header().StreamID, false)
+		}
+
 		switch f := f.(type) {
 		case *MetaHeadersFrame:
 			err = rl.processHeaders(f)
@@ -1827,6 +2224,9 @@ func (rl *clientConnReadLoop) run() error {
 		default:
 			cc.logf("Transport: unhandled response frame type %T", f)
 		}
+		if traced {
+			cc.traceFrame(frameEvent(f), tracedStream)
+		}
 		if err != nil {
 			if VerboseLogs {
 				cc.vlogf("http2: Transport conn %p received error from processing frame %v: %v", cc, summarizeFrame(f), err)
@@ -2047,7 +2447,28 @@ func (b transportResponseBody) Read(p []byte) (n int, err error) {
 	if cs.readErr != nil {
 		return 0, cs.readErr
 	}
-	n, err = b.cs.bufPipe.Read(p)
+	// do not take more than the choke point from the pipe
+	cc.mu.Lock()
+	if cs.chokeAt > 0 {
+		left := cs.chokeAt - cs.delivered
+		if left == 0 {
+			cc.mu.Unlock()
+			cs.readErr = ChokedError{Delivered: cs.chokeAt}
+			return 0, cs.readErr
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	cc.mu.Unlock()
+	// nor more than a choke point moved earlier while waiting for data: what
+	// follows in p may already be written by another stream
+	n, err = b.cs.bufPipe.readUpTo(p, func() int {
+		if cs.chokeAt > 0 && int64(len(p)) > cs.chokeAt-cs.delivered {
+			return int(cs.chokeAt - cs.delivered)
+		}
+		return len(p)
+	})
 	if cs.bytesRemain != -1 {
 		if int64(n) > cs.bytesRemain {
 			n = int(cs.bytesRemain)
@@ -2073,31 +2494,35 @@ func (b transportResponseBody) Read(p []byte) (n int, err error) {
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
 
+	// the choke point may have moved earlier during bufPipe.Read
+	if cs.chokeAt > 0 && cs.delivered+int64(n) >= cs.chokeAt {
+		n = int(cs.chokeAt - cs.delivered)
+		if err == nil {
+			err = ChokedError{Delivered: cs.chokeAt}
+			cs.readErr = err
+		}
+	}
+	cs.delivered += int64(n)
+
 	var connAdd, streamAdd int32
 	// Check the conn-level first, before the stream-level.
-	if v := cc.inflow.available(); v < transportDefaultConnFlow/2 {
-		connAdd = transportDefaultConnFlow - v
+	if v := cc.inflow.available(); v < cc.connWindow/2 {
+		connAdd = cc.connWindow - v
 		cc.inflow.add(connAdd)
 	}
 	if err == nil { // No need to refresh if the stream is over or failed.
-		// Consider any buffered body data (read from the conn but not
-		// consumed by the client) when computing flow control for this
-		// stream.
-		v := int(cs.inflow.available()) + cs.bufPipe.Len()
-		if v < transportDefaultStreamFlow-transportDefaultStreamMinRefresh {
-			streamAdd = int32(transportDefaultStreamFlow - v)
-			cs.inflow.add(streamAdd)
-		}
+		streamAdd = cs.refreshWindowLocked()
 	}
 	if connAdd != 0 || streamAdd != 0 {
 		cc.wmu.Lock()
 		defer cc.wmu.Unlock()
 		if connAdd != 0 {
 			cc.fr.WriteWindowUpdate(0, mustUint31(connAdd))
+			cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, Increment: uint32(connAdd)}, nil)
 		}
-		if streamAdd != 0 && !cs.choked {
+		if streamAdd != 0 {
 			cc.fr.WriteWindowUpdate(cs.ID, mustUint31(streamAdd))
-			cs.tokensSent += int64(streamAdd)
+			cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, StreamID: cs.ID, Increment: uint32(streamAdd)}, cs)
 		}
 		cc.bw.Flush()
 	}
@@ -2116,14 +2541,16 @@ func (b transportResponseBody) Close() error {
 	if unread > 0 || !serverSentStreamEnd {
 		cc.mu.Lock()
 		cc.wmu.Lock()
-		if !serverSentStreamEnd {
+		if !serverSentStreamEnd && !cs.didReset {
 			cc.fr.WriteRSTStream(cs.ID, ErrCodeCancel)
 			cs.didReset = true
+			cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameRSTStream, StreamID: cs.ID, ErrCode: ErrCodeCancel}, cs)
 		}
 		// Return connection-level flow control.
 		if unread > 0 {
 			cc.inflow.add(int32(unread))
 			cc.fr.WriteWindowUpdate(0, uint32(unread))
+			cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, Increment: uint32(unread)}, nil)
 		}
 		cc.bw.Flush()
 		cc.wmu.Unlock()
@@ -2137,6 +2564,12 @@ func (b transportResponseBody) Close() error {
 
 func (rl *clientConnReadLoop) processData(f *DataFrame) error {
 	cc := rl.cc
+	if cc.bdp != nil && f.Length > 0 && cc.bdp.add(f.Length) {
+		if err := cc.sendBDPPing(); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&cc.dataRead, int64(f.Length))
 	cs := cc.streamByID(f.StreamID, f.StreamEnded())
 	data := f.Data()
 	if cs == nil {
@@ -2163,6 +2596,7 @@ func (rl *clientConnReadLoop) processData(f *DataFrame) error {
 			cc.fr.WriteWindowUpdate(0, uint32(f.Length))
 			cc.bw.Flush()
 			cc.wmu.Unlock()
+			cc.traceFrame(FrameEvent{Sent: true, Type: FrameWindowUpdate, Increment: f.Length}, nil)
 		}
 		return nil
 	}
@@ -2209,15 +2643,24 @@ func (rl *clientConnReadLoop) processData(f *DataFrame) error {
 			cc.inflow.add(int32(refund))
 			cc.wmu.Lock()
 			cc.fr.WriteWindowUpdate(0, uint32(refund))
+			cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, Increment: uint32(refund)}, nil)
 			if !didReset {
 				cs.inflow.add(int32(refund))
 				cc.fr.WriteWindowUpdate(cs.ID, uint32(refund))
+				cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, StreamID: cs.ID, Increment: uint32(refund)}, cs)
 				// padding does not count as stream data, so we do not increase cs.tokensSent
 				// also we do not turn off WINDOW_UPDATE here, as refund was bytes not carrying data
 			}
 			cc.bw.Flush()
 			cc.wmu.Unlock()
 		}
+		if !didReset && len(data) > 0 {
+			if cs.received == 0 {
+				cs.firstDataAt = time.Now()
+			}
+			cs.received += int64(len(data))
+		}
+		chokeReached := !f.StreamEnded() && cs.resetChokedLocked()
 		cc.mu.Unlock()
 
 		if len(data) > 0 && !didReset {
@@ -2226,6 +2669,9 @@ func (rl *clientConnReadLoop) processData(f *DataFrame) error {
 				return err
 			}
 		}
+		if chokeReached {
+			cs.endChoked()
+		}
 	}
 
 	if f.StreamEnded() {
@@ -2408,9 +2854,12 @@ func (cc *ClientConn) Ping(ctx context.Context) error {
 		cc.wmu.Unlock()
 		return err
 	}
+	sent := time.Now()
 	cc.wmu.Unlock()
+	cc.traceFrame(FrameEvent{Sent: true, Type: FramePing}, nil)
 	select {
 	case <-c:
+		cc.setRTT(time.Since(sent))
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
@@ -2421,6 +2870,15 @@ func (cc *ClientConn) Ping(ctx context.Context) error {
 }
 
 func (rl *clientConnReadLoop) processPing(f *PingFrame) error {
+	if f.IsAck() && rl.cc.bdp != nil && f.Data == bdpPing {
+		if !rl.cc.bdp.sentAt.IsZero() {
+			rl.cc.setRTT(time.Since(rl.cc.bdp.sentAt))
+		}
+		if bdp := rl.cc.bdp.calculate(); bdp != 0 {
+			return rl.cc.growWindows(bdp)
+		}
+		return nil
+	}
 	if f.IsAck() {
 		cc := rl.cc
 		cc.mu.Lock()
@@ -2434,13 +2892,73 @@ func (rl *clientConnReadLoop) processPing(f *PingFrame) error {
 	}
 	cc := rl.cc
 	cc.wmu.Lock()
-	defer cc.wmu.Unlock()
 	if err := cc.fr.WritePing(true, f.Data); err != nil {
+		cc.wmu.Unlock()
 		return err
 	}
+	err := cc.bw.Flush()
+	cc.wmu.Unlock()
+	cc.traceFrame(FrameEvent{Sent: true, Type: FramePing, Flags: FlagPingAck}, nil)
+	return err
+}
+
+func (cc *ClientConn) setRTT(rtt time.Duration) {
+	cc.mu.Lock()
+	cc.rtt = rtt
+	cc.mu.Unlock()
+}
+
+// sendBDPPing starts a sample of the bandwidth-delay product.
+func (cc *ClientConn) sendBDPPing() error {
+	cc.wmu.Lock()
+	if err := cc.fr.WritePing(false, bdpPing); err != nil {
+		cc.wmu.Unlock()
+		return err
+	}
+	err := cc.bw.Flush()
+	cc.bdp.sent()
+	cc.wmu.Unlock()
+	cc.traceFrame(FrameEvent{Sent: true, Type: FramePing}, nil)
+	return err
+}
+
+// growWindows opens the receive windows of the connection and its streams up
+// to bdp, the bandwidth-delay product estimated, within the caps of the
+// Transport.
+func (cc *ClientConn) growWindows(bdp uint32) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	if w := min32(int32(bdp), cc.t.maxConnWindow()); w > cc.connWindow {
+		connAdd := w - cc.connWindow
+		cc.connWindow = w
+		cc.inflow.add(connAdd)
+		cc.fr.WriteWindowUpdate(0, uint32(connAdd))
+		cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, Increment: uint32(connAdd)}, nil)
+	}
+	if w := min32(int32(bdp), cc.t.maxStreamWindow()); w > cc.streamWindow {
+		cc.streamWindow = w
+		for _, cs := range cc.streams {
+			if cs.didReset {
+				continue
+			}
+			if streamAdd := cs.refreshWindowLocked(); streamAdd != 0 {
+				cc.fr.WriteWindowUpdate(cs.ID, uint32(streamAdd))
+				cc.traceFrameLocked(FrameEvent{Sent: true, Type: FrameWindowUpdate, StreamID: cs.ID, Increment: uint32(streamAdd)}, cs)
+			}
+		}
+	}
 	return cc.bw.Flush()
 }
 
+func min32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func (rl *clientConnReadLoop) processPushPromise(f *PushPromiseFrame) error {
 	// We told the peer we don't want them.
 	// Spec says:
@@ -2461,6 +2979,9 @@ func (cc *ClientConn) writeStreamReset(streamID uint32, code ErrCode, err error)
 	cc.fr.WriteRSTStream(streamID, code)
 	cc.bw.Flush()
 	cc.wmu.Unlock()
+	if cc.t.FrameTrace != nil {
+		cc.traceFrame(FrameEvent{Sent: true, Type: FrameRSTStream, StreamID: streamID, ErrCode: code}, cc.streamByID(streamID, false))
+	}
 }
 
 var (
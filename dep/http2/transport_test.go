@@ -3199,7 +3199,7 @@ func TestRoundTripDoesntConsumeRequestBodyEarly(t *testing.T) {
 	cc := &ClientConn{
 		closed: true,
 	}
-	_, err := cc.RoundTrip(req)
+	_, _, err := cc.RoundTrip(req)
 	if err != errClientConnUnusable {
 		t.Fatalf("RoundTrip = %v; want errClientConnUnusable", err)
 	}
@@ -4116,7 +4116,7 @@ func testClientConnClose(t *testing.T, closeMode closeMode) {
 			w.(http.Flusher).Flush()
 		}
 	}
-	res, err := cc.RoundTrip(req)
+	res, _, err := cc.RoundTrip(req)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -4557,3 +4557,517 @@ func TestClientConnTooIdle(t *testing.T) {
 		}
 	}
 }
+
+func TestTransportFrameTrace(t *testing.T) {
+	const bodySize = 2*transportDefaultStreamFlow + 1000
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(bodySize))
+		w.Write(make([]byte, bodySize))
+	}, optOnlyServer)
+	defer st.Close()
+
+	var mu sync.Mutex
+	var evs []FrameEvent
+	tr := &Transport{
+		TLSClientConfig: tlsConfigInsecure,
+		FrameTrace: func(ev FrameEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			evs = append(evs, ev)
+		},
+	}
+	c, err := tls.Dial("tcp", st.ts.Listener.Addr().String(), tr.newTLSConfig(st.ts.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, err := tr.NewClientConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, cs, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	if err != nil || n != bodySize {
+		t.Fatalf("read %d bytes, %v; want %d", n, err, bodySize)
+	}
+	res.Body.Close()
+	if err := cc.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var dataRead, granted int64
+	var gotEnd, gotPing, gotPingAck bool
+	tokens := int64(transportDefaultStreamFlow)
+	for _, ev := range evs {
+		if ev.Time.IsZero() {
+			t.Errorf("%+v: no time", ev)
+		}
+		switch {
+		case ev.Type == FrameData && !ev.Sent && ev.StreamID == cs.ID:
+			dataRead += int64(ev.Length)
+			gotEnd = gotEnd || ev.Flags.Has(FlagDataEndStream)
+			if want := int32(tokens + granted - dataRead); ev.StreamInflow != want {
+				t.Errorf("%+v: stream window %d; want %d", ev, ev.StreamInflow, want)
+			}
+		case ev.Type == FrameWindowUpdate && ev.Sent && ev.StreamID == cs.ID:
+			granted += int64(ev.Increment)
+			if ev.TokensSent != tokens+granted {
+				t.Errorf("%+v: tokens sent %d; want %d", ev, ev.TokensSent, tokens+granted)
+			}
+		case ev.Type == FramePing && ev.Sent:
+			gotPing = true
+		case ev.Type == FramePing && !ev.Sent:
+			gotPingAck = ev.Flags.Has(FlagPingAck)
+		}
+		if ev.ConnInflow < 0 {
+			t.Errorf("%+v: negative connection window", ev)
+		}
+	}
+	if dataRead != bodySize || !gotEnd {
+		t.Errorf("traced %d bytes of DATA, END_STREAM %v; want %d bytes and END_STREAM", dataRead, gotEnd, bodySize)
+	}
+	if granted == 0 {
+		t.Error("no stream WINDOW_UPDATE traced")
+	}
+	if !gotPing || !gotPingAck {
+		t.Errorf("PING traced %v, ack traced %v", gotPing, gotPingAck)
+	}
+}
+
+func TestTransportChokeAt(t *testing.T) {
+	const mb = 1 << 20
+	const bodySize = 10 * mb
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(bodySize))
+		w.Write(make([]byte, bodySize))
+	}, optOnlyServer)
+	defer st.Close()
+
+	var mu sync.Mutex
+	var maxTokens = map[uint32]int64{}
+	tr := &Transport{
+		TLSClientConfig: tlsConfigInsecure,
+		FrameTrace: func(ev FrameEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ev.TokensSent > maxTokens[ev.StreamID] {
+				maxTokens[ev.StreamID] = ev.TokensSent
+			}
+		},
+	}
+	c, err := tls.Dial("tcp", st.ts.Listener.Addr().String(), tr.newTLSConfig(st.ts.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, err := tr.NewClientConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each step reads the body up to after, then chokes at at
+	type step struct {
+		after, at int64
+		err       error
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		want    int64 // bytes read
+		choked  bool  // the body ended with a ChokedError rather than io.EOF
+		granted int64 // most stream window granted, if checked
+	}{
+		{"once", []step{{0, 6 * mb, nil}, {0, 6 * mb, nil}}, 6 * mb, true, 6 * mb},
+		{"earlier", []step{{0, 6 * mb, nil}, {mb, 2 * mb, nil}}, 2 * mb, true, 0},
+		// the server cannot have sent more than a window past what was read
+		{"later", []step{{0, 6 * mb, nil}, {mb, 8 * mb, nil}}, 8 * mb, true, 8 * mb},
+		{"too late", []step{{3 * mb, mb, ErrChokeTooLate}}, bodySize, false, 0},
+		{"lift", []step{{0, 6 * mb, nil}, {mb, bodySize, nil}}, bodySize, false, 0},
+		{"invalid", []step{{0, 0, errChokeNotPositive}, {0, bodySize + 1, errChokeBeyondBody}}, bodySize, false, 0},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		res, cs, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var read int64
+		for _, s := range tt.steps {
+			n, err := io.CopyN(ioutil.Discard, res.Body, s.after-read)
+			read += n
+			if err != nil {
+				t.Fatalf("%s: reading to %d: %v", tt.name, s.after, err)
+			}
+			if err := cs.ChokeAt(s.at); err != s.err {
+				t.Errorf("%s: ChokeAt(%d) after %d bytes = %v; want %v", tt.name, s.at, s.after, err, s.err)
+			}
+		}
+		n, err := io.Copy(ioutil.Discard, res.Body)
+		read += n
+		res.Body.Close()
+		ce, choked := err.(ChokedError)
+		if read != tt.want || choked != tt.choked || (err != nil && !choked) {
+			t.Errorf("%s: read %d bytes, %v; want %d bytes, choked %v", tt.name, read, err, tt.want, tt.choked)
+		}
+		if choked && ce.Delivered != read {
+			t.Errorf("%s: %v after %d bytes", tt.name, err, read)
+		}
+		mu.Lock()
+		if tt.granted != 0 && maxTokens[cs.ID] != tt.granted {
+			t.Errorf("%s: granted %d bytes of window; want %d", tt.name, maxTokens[cs.ID], tt.granted)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestTransportChokeAtResets(t *testing.T) {
+	const mb = 1 << 20
+	const bodySize = 10 * mb
+	const maxStreams = 2
+	handlerErrs := make(chan error, 10)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(bodySize))
+		_, err := w.Write(make([]byte, bodySize))
+		handlerErrs <- err
+	}, optOnlyServer, func(s *Server) {
+		s.MaxConcurrentStreams = maxStreams
+	})
+	defer st.Close()
+
+	var mu sync.Mutex
+	resets := map[uint32]ErrCode{}
+	tr := &Transport{
+		TLSClientConfig: tlsConfigInsecure,
+		FrameTrace: func(ev FrameEvent) {
+			if ev.Type == FrameRSTStream && ev.Sent {
+				mu.Lock()
+				defer mu.Unlock()
+				resets[ev.StreamID] = ev.ErrCode
+			}
+		},
+	}
+	c, err := tls.Dial("tcp", st.ts.Listener.Addr().String(), tr.newTLSConfig(st.ts.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, err := tr.NewClientConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more choked streams than the server runs at a time, their bodies left open:
+	// the transport resets them itself
+	for i := 0; i < 2*maxStreams; i++ {
+		// the request is canceled only if the choke did not do it first
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		req, _ := http.NewRequest("GET", st.ts.URL, nil)
+		res, cs, err := cc.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		chokeAt := int64(mb + i)
+		if err := cs.ChokeAt(chokeAt); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-cs.Done():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("request %d: stream not done after the choke point", i)
+		}
+		n, err := io.Copy(ioutil.Discard, res.Body)
+		if n != chokeAt || err != (ChokedError{Delivered: chokeAt}) {
+			t.Errorf("request %d: read %d bytes, %v; want %d bytes choked", i, n, err, chokeAt)
+		}
+		if err := cs.ChokeAt(chokeAt + 1); err != ErrChokeTooLate {
+			t.Errorf("request %d: extending a reset stream = %v; want ErrChokeTooLate", i, err)
+		}
+		select {
+		case err := <-handlerErrs:
+			if err == nil {
+				t.Errorf("request %d: handler wrote the whole body", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %d: handler still writing after the reset", i)
+		}
+		mu.Lock()
+		if code, ok := resets[cs.ID]; !ok || code != ErrCodeCancel {
+			t.Errorf("request %d: RST_STREAM sent %v, code %v; want CANCEL", i, ok, code)
+		}
+		mu.Unlock()
+	}
+
+	// and the connection is still good for a whole body
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, _, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if n != bodySize || err != nil {
+		t.Errorf("after the chokes: read %d bytes, %v; want %d", n, err, bodySize)
+	}
+	if !cc.CanTakeNewRequest() {
+		t.Error("connection unusable after the chokes")
+	}
+}
+
+func TestTransportAdaptiveWindow(t *testing.T) {
+	const mb = 1 << 20
+	const bodySize = 10 * mb
+	const maxWindow = mb
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(bodySize))
+		w.Write(make([]byte, bodySize))
+	}, optOnlyServer)
+	defer st.Close()
+
+	var mu sync.Mutex
+	var maxInflow int32
+	var pings int
+	maxTokens := map[uint32]int64{}
+	tr := &Transport{
+		TLSClientConfig: tlsConfigInsecure,
+		AdaptiveWindow:  true,
+		MaxStreamWindow: maxWindow,
+		FrameTrace: func(ev FrameEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ev.StreamInflow > maxInflow {
+				maxInflow = ev.StreamInflow
+			}
+			if ev.TokensSent > maxTokens[ev.StreamID] {
+				maxTokens[ev.StreamID] = ev.TokensSent
+			}
+			if ev.Type == FramePing && ev.Sent {
+				pings++
+			}
+		},
+	}
+	c, err := tls.Dial("tcp", st.ts.Listener.Addr().String(), tr.newTLSConfig(st.ts.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, err := tr.NewClientConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, _, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if n != bodySize || err != nil {
+		t.Fatalf("read %d bytes, %v; want %d", n, err, bodySize)
+	}
+	mu.Lock()
+	if pings == 0 || maxInflow <= initialWindowSize || maxInflow > maxWindow {
+		t.Errorf("stream window grew to %d with %d PINGs; want in (%d, %d]", maxInflow, pings,
+			initialWindowSize, maxWindow)
+	}
+	mu.Unlock()
+
+	// the windows grown keep to the choke point
+	const chokeAt = 3*mb + 123
+	req, _ = http.NewRequest("GET", st.ts.URL, nil)
+	res, cs, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.ChokeAt(chokeAt); err != nil {
+		t.Fatal(err)
+	}
+	n, err = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if _, choked := err.(ChokedError); n != chokeAt || !choked {
+		t.Errorf("read %d bytes, %v; want %d, choked", n, err, chokeAt)
+	}
+	mu.Lock()
+	if maxTokens[cs.ID] != chokeAt {
+		t.Errorf("granted %d bytes of window; want %d", maxTokens[cs.ID], chokeAt)
+	}
+	mu.Unlock()
+}
+
+func TestTransportPull(t *testing.T) {
+	const bodySize = 1 << 20
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(bodySize))
+		w.Write(make([]byte, bodySize))
+	}, optOnlyServer)
+	defer st.Close()
+
+	var mu sync.Mutex
+	maxTokens := map[uint32]int64{}
+	tr := &Transport{
+		TLSClientConfig: tlsConfigInsecure,
+		PullStreams:     true,
+		FrameTrace: func(ev FrameEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ev.TokensSent > maxTokens[ev.StreamID] {
+				maxTokens[ev.StreamID] = ev.TokensSent
+			}
+		},
+	}
+	c, err := tls.Dial("tcp", st.ts.Listener.Addr().String(), tr.newTLSConfig(st.ts.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, err := tr.NewClientConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readN := func(body io.Reader, want int64) {
+		t.Helper()
+		if n, err := io.CopyN(ioutil.Discard, body, want); err != nil {
+			t.Fatalf("read %d bytes of %d: %v", n, want, err)
+		}
+	}
+
+	// the streams not pulled get their window all the same
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, _, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readN(res.Body, bodySize)
+	res.Body.Close()
+
+	// pausing, throttling, then choking a pulled stream
+	req, _ = http.NewRequest("GET", st.ts.URL, nil)
+	res, cs, err := cc.RoundTripPull(req, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readN(res.Body, 100000)
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(res.Body, make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("read past the credit: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n, err := cs.Pull(50000); n != 50000 || err != nil {
+		t.Fatalf("Pull(50000) = %d, %v", n, err)
+	}
+	if err := <-read; err != nil {
+		t.Fatal(err)
+	}
+	readN(res.Body, 50000-1)
+	if err := cs.ChokeAt(200000); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := cs.Pull(bodySize); n != 50000 || err != nil {
+		t.Errorf("Pull(%d) up to the choke point = %d, %v; want 50000", bodySize, n, err)
+	}
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if _, choked := err.(ChokedError); n != 50000 || !choked {
+		t.Errorf("read %d bytes, %v; want 50000, choked", n, err)
+	}
+	mu.Lock()
+	if maxTokens[cs.ID] != 200000 {
+		t.Errorf("granted %d bytes of window; want 200000", maxTokens[cs.ID])
+	}
+	mu.Unlock()
+	if n, err := cs.Pull(1); n != 0 || err != nil {
+		t.Errorf("Pull on a stream over = %d, %v", n, err)
+	}
+
+	// pulling past the end, or not pulling any more
+	for _, unpull := range []bool{false, true} {
+		req, _ = http.NewRequest("GET", st.ts.URL, nil)
+		res, cs, err = cc.RoundTripPull(req, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unpull {
+			if err := cs.Unpull(); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			if _, err := cs.Pull(0); err != errPullNotPositive {
+				t.Errorf("Pull(0) = %v; want %v", err, errPullNotPositive)
+			}
+			if n, err := cs.Pull(2 * bodySize); n != bodySize || err != nil {
+				t.Errorf("Pull(%d) = %d, %v; want %d", 2*bodySize, n, err, bodySize)
+			}
+		}
+		n, err = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if n != bodySize || err != nil {
+			t.Errorf("unpull %v: read %d bytes, %v; want %d", unpull, n, err, bodySize)
+		}
+	}
+}
+
+func TestTransportStats(t *testing.T) {
+	const bodySize = 8 << 20 // past the window, so that the stream stays open until read
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(bodySize))
+		w.Write(make([]byte, bodySize))
+	}, optOnlyServer)
+	defer st.Close()
+
+	tr := &Transport{TLSClientConfig: tlsConfigInsecure}
+	c, err := tls.Dial("tcp", st.ts.Listener.Addr().String(), tr.newTLSConfig(st.ts.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cc, err := tr.NewClientConn(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", st.ts.URL, nil)
+	res, cs, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cc.Stats(); s.ActiveStreams != 1 || s.RTT <= 0 || s.PeerMaxConcurrentStreams == 0 ||
+		s.StreamWindow != transportDefaultStreamFlow {
+		t.Errorf("conn stats during the body: %+v", s)
+	}
+	if _, err := io.CopyN(ioutil.Discard, res.Body, bodySize/2); err != nil {
+		t.Fatal(err)
+	}
+	if s := cs.Stats(); s.Delivered != bodySize/2 || s.Received != s.Delivered+int64(s.Buffered) ||
+		s.TimeToFirstByte <= 0 || s.TokensSent < s.Received {
+		t.Errorf("stream stats halfway: %+v", s)
+	}
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	<-cs.Done()
+
+	if s := cs.Stats(); s.Received != bodySize || s.Delivered != bodySize || s.Buffered != 0 || s.Reset {
+		t.Errorf("stream stats at the end: %+v", s)
+	}
+	s := cc.Stats()
+	if s.ActiveStreams != 0 || s.DataRead < bodySize || s.FramesRead == 0 ||
+		s.BytesRead < s.DataRead+frameHeaderLen*s.FramesRead {
+		t.Errorf("conn stats at the end: %+v", s)
+	}
+}
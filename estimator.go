@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BandwidthEstimator turns the rate samples of a path, taken every bwSampleInterval, into
+// the rate the scheduler splits and chokes with
+type BandwidthEstimator interface {
+	// Add takes a sample in bytes per second
+	Add(sample int64)
+	// Rate is the estimate in bytes per second, 0 before any sample
+	Rate() int64
+	// Clone copies the estimator with its history, for the next fragments of a download
+	Clone() BandwidthEstimator
+}
+
+const (
+	// maxSampleDepth is how many samples the mean and the harmonic mean take
+	maxSampleDepth = 5
+	// ewmaTimeConstant is how long a sample weighs in the EWMA, whatever the sample
+	// interval; about the span of the samples of the mean at the default interval
+	ewmaTimeConstant = 50 * time.Millisecond
+	// maxFilterWindow is how long the windowed max remembers a sample
+	maxFilterWindow = 200 * time.Millisecond
+)
+
+// estimators are selectable by name with --estimator
+var estimators = map[string]func() BandwidthEstimator{
+	"mean":     func() BandwidthEstimator { return &meanEstimator{} },
+	"ewma":     newEWMAEstimator,
+	"max":      newMaxEstimator,
+	"harmonic": func() BandwidthEstimator { return &harmonicEstimator{} },
+}
+
+// estimatorName is the estimator of the BwCounters, see estimators
+var estimatorName = "mean"
+
+func estimatorNames() string {
+	var names []string
+	for name := range estimators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// logEstimator records the estimator and the sample interval of the run
+func logEstimator() {
+	logEvent("estimator", -1, eventFields{"name": estimatorName, "interval": msec(bwSampleInterval)})
+}
+
+// meanEstimator is the mean of the last maxSampleDepth samples
+type meanEstimator struct {
+	samples []int64
+	sum     int64
+}
+
+func (e *meanEstimator) Add(sample int64) {
+	e.samples = append(e.samples, sample)
+	e.sum += sample
+	if len(e.samples) > maxSampleDepth {
+		e.sum -= e.samples[0]
+		e.samples = e.samples[1:]
+	}
+}
+
+func (e *meanEstimator) Rate() int64 {
+	if len(e.samples) == 0 {
+		return 0
+	}
+	return e.sum / int64(len(e.samples))
+}
+
+func (e *meanEstimator) Clone() BandwidthEstimator {
+	return &meanEstimator{samples: append([]int64(nil), e.samples...), sum: e.sum}
+}
+
+// ewmaEstimator is an exponentially weighted moving average, the weight of a sample
+// decaying with ewmaTimeConstant
+type ewmaEstimator struct {
+	alpha float64 // weight of a new sample
+	rate  float64
+	init  bool // a sample was taken
+}
+
+func newEWMAEstimator() BandwidthEstimator {
+	return &ewmaEstimator{alpha: 1 - math.Exp(-float64(bwSampleInterval)/float64(ewmaTimeConstant))}
+}
+
+func (e *ewmaEstimator) Add(sample int64) {
+	if !e.init {
+		e.rate, e.init = float64(sample), true
+		return
+	}
+	e.rate += e.alpha * (float64(sample) - e.rate)
+}
+
+func (e *ewmaEstimator) Rate() int64 {
+	return int64(e.rate)
+}
+
+func (e *ewmaEstimator) Clone() BandwidthEstimator {
+	clone := *e
+	return &clone
+}
+
+// maxEstimator is the highest sample of the last maxFilterWindow, as the bottleneck
+// bandwidth filter of BBR: deliveries are only ever slowed down, by queues and by the
+// sender, so the fastest recent one tells the capacity of the path
+type maxEstimator struct {
+	samples []int64
+	depth   int
+}
+
+func newMaxEstimator() BandwidthEstimator {
+	depth := int(maxFilterWindow / bwSampleInterval)
+	if depth < 1 {
+		depth = 1
+	}
+	return &maxEstimator{depth: depth}
+}
+
+func (e *maxEstimator) Add(sample int64) {
+	e.samples = append(e.samples, sample)
+	if len(e.samples) > e.depth {
+		e.samples = e.samples[1:]
+	}
+}
+
+func (e *maxEstimator) Rate() int64 {
+	var max int64
+	for _, sample := range e.samples {
+		if sample > max {
+			max = sample
+		}
+	}
+	return max
+}
+
+func (e *maxEstimator) Clone() BandwidthEstimator {
+	return &maxEstimator{samples: append([]int64(nil), e.samples...), depth: e.depth}
+}
+
+// harmonicEstimator is the harmonic mean of the last maxSampleDepth samples, which the
+// outliers of a bursty path pull up less than the mean.  Samples without progress are
+// left out, or any would take the mean to zero.
+type harmonicEstimator struct {
+	samples []int64
+}
+
+func (e *harmonicEstimator) Add(sample int64) {
+	e.samples = append(e.samples, sample)
+	if len(e.samples) > maxSampleDepth {
+		e.samples = e.samples[1:]
+	}
+}
+
+func (e *harmonicEstimator) Rate() int64 {
+	var inverses float64
+	var n int
+	for _, sample := range e.samples {
+		if sample > 0 {
+			inverses += 1 / float64(sample)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return int64(float64(n) / inverses)
+}
+
+func (e *harmonicEstimator) Clone() BandwidthEstimator {
+	return &harmonicEstimator{samples: append([]int64(nil), e.samples...)}
+}
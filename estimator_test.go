@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEstimators(t *testing.T) {
+	samples := []int64{100, 0, 400, 100, 200, 800}
+	for _, test := range []struct {
+		name string
+		rate int64
+	}{
+		// the last 5 samples
+		{"mean", (0 + 400 + 100 + 200 + 800) / 5},
+		// every sample, within the 200ms window at 10ms
+		{"max", 800},
+		// of the last 5 without the 0: 4 / (1/400 + 1/100 + 1/200 + 1/800)
+		{"harmonic", 213},
+	} {
+		est := estimators[test.name]()
+		if est.Rate() != 0 {
+			t.Errorf("%s: rate before any sample = %d", test.name, est.Rate())
+		}
+		for _, sample := range samples {
+			est.Add(sample)
+		}
+		if rate := est.Rate(); rate != test.rate {
+			t.Errorf("%s: rate = %d, want %d", test.name, rate, test.rate)
+		}
+	}
+}
+
+func TestEWMAEstimator(t *testing.T) {
+	est := newEWMAEstimator()
+	est.Add(1000)
+	if rate := est.Rate(); rate != 1000 {
+		t.Errorf("rate after the first sample = %d", rate)
+	}
+	// one time constant of a new rate goes about 63% of the way
+	for i := 0; i < int(ewmaTimeConstant/bwSampleInterval); i++ {
+		est.Add(2000)
+	}
+	if rate := est.Rate(); rate < 1600 || rate > 1660 {
+		t.Errorf("rate after %v = %d", ewmaTimeConstant, rate)
+	}
+}
+
+func TestEstimatorClone(t *testing.T) {
+	for name := range estimators {
+		est := estimators[name]()
+		est.Add(1000)
+		clone := est.Clone()
+		clone.Add(3000)
+		if rate := est.Rate(); rate != 1000 {
+			t.Errorf("%s: rate after a sample added to the clone = %d", name, rate)
+		}
+		if rate := clone.Rate(); rate <= 1000 {
+			t.Errorf("%s: rate of the clone = %d", name, rate)
+		}
+	}
+}
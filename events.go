@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventLog writes the decisions of the multipath engine as JSON lines, e.g.
+//
+//	{"t":12.345,"event":"choke","path":2,"chokeAt":81920,"inflight":40960,...}
+//
+// t is in milliseconds since globalStart.  path is the index of the server on the command
+// line, and absent for events concerning all paths.
+type eventLog struct {
+	f   *os.File
+	w   *bufio.Writer
+	mux sync.Mutex // protects w
+}
+
+// events is the log enabled with --events; nil if disabled
+var events *eventLog
+
+// eventFields are the details of an event
+type eventFields map[string]interface{}
+
+func createEventLog(name string) (*eventLog, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// logEvent records an event of kind on path (-1 for none) in the event log and the report,
+// and counts it in the metrics, if enabled
+func logEvent(kind string, path int, fields eventFields) {
+	if events == nil && report == nil && metrics == nil {
+		return
+	}
+	t := time.Since(globalStart)
+	if events != nil {
+		events.log(t, kind, path, fields)
+	}
+	if report != nil {
+		report.event(t, kind, path, fields)
+	}
+	if metrics != nil {
+		metrics.event(kind, path, fields)
+	}
+}
+
+func (l *eventLog) log(t time.Duration, kind string, path int, fields eventFields) {
+	line := fmt.Sprintf(`{"t":%.3f,"event":"%s"`, msec(t), kind)
+	if path >= 0 {
+		line += fmt.Sprintf(`,"path":%d`, path)
+	}
+	if len(fields) > 0 {
+		b, err := json.Marshal(fields)
+		fatal("encode event", err)
+		// the fields go inside the same object
+		line += "," + string(b[1:len(b)-1])
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	fmt.Fprintln(l.w, line+"}")
+}
+
+func (l *eventLog) Close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// rangeList is how ranges appear in events: [[start, end], ...] with end exclusive
+func rangeList(ranges []contentRange) [][2]int {
+	list := make([][2]int, len(ranges))
+	for i, r := range ranges {
+		list[i] = [2]int{r.start, r.end}
+	}
+	return list
+}
+
+// msec is how durations appear in events
+func msec(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
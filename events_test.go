@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	var err error
+	if events, err = createEventLog("events.jsonl"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		events = nil
+	}()
+
+	content := randomContent(4 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler,
+		LinkConfig{Rate: 4 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 2 << 20, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 1 << 20, Delay: 40 * time.Millisecond, Queue: 128 << 10})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+	download("/content", servers, out)
+	if err := events.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open("events.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	seen := map[string]int{}
+	var assigned int
+	assignedPaths := map[int]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev struct {
+			T     *float64
+			Event string
+			Path  *int
+			Start int
+			End   int
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+		if ev.T == nil || ev.Event == "" {
+			t.Errorf("event without time or kind: %s", scanner.Text())
+		}
+		switch ev.Event {
+		case "connect", "ready", "rtt", "tcpinfo", "rate", "assign", "complete", "choke":
+			if ev.Path == nil || *ev.Path < 0 || *ev.Path >= len(servers) {
+				t.Errorf("event without path: %s", scanner.Text())
+			}
+		}
+		if ev.Event == "assign" {
+			assigned += ev.End - ev.Start
+			assignedPaths[*ev.Path] = true
+		}
+		seen[ev.Event]++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"connect", "ready", "rtt", "rate", "split", "assign", "complete"} {
+		if seen[kind] == 0 {
+			t.Errorf("no %s events in %v", kind, seen)
+		}
+	}
+	if seen["connect"] != len(servers) || assigned < len(content) || len(assignedPaths) != len(servers) {
+		t.Errorf("%d connections, %d of %d bytes assigned to paths %v", seen["connect"], assigned,
+			len(content), assignedPaths)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// linkMTU is the size of the packets data is cut into on an emulated link
+	linkMTU = 1500
+	// linkMinRTO is the minimum retransmission timeout of Linux TCP, which delays a lost
+	// packet (and everything behind it) on an emulated link
+	linkMinRTO = 200 * time.Millisecond
+)
+
+// LinkConfig describes one direction of an emulated link
+type LinkConfig struct {
+	Rate   int64         // bottleneck rate in bytes per second; 0 means unlimited
+	Delay  time.Duration // one-way propagation delay
+	Jitter time.Duration // random extra delay, uniform in [0, Jitter)
+	Loss   float64       // probability that a packet has to be retransmitted
+	Queue  int64         // bottleneck buffer in bytes; writers block while it is full; 0 means unlimited
+
+	// Trace replays a mahimahi packet delivery trace instead of a fixed Rate: every entry
+	// is a time at which one packet may leave the bottleneck.  Opportunities nothing is
+	// queued for are lost, and the trace starts over after its last entry, as in mm-link.
+	Trace []time.Duration
+
+	// Schedule changes the link over time; the steps must be sorted by At.  With a
+	// non-zero Period the schedule starts over every Period.
+	Schedule []LinkStep
+	Period   time.Duration
+}
+
+// LinkStep switches the rate, delay, jitter, loss and queue of a link to those of
+// Config once At has passed since the link was set up
+type LinkStep struct {
+	At     time.Duration
+	Config LinkConfig
+}
+
+// IsZero tells if the link does not shape at all
+func (c LinkConfig) IsZero() bool {
+	return c.Rate == 0 && c.Delay == 0 && c.Jitter == 0 && c.Loss == 0 && c.Queue == 0 &&
+		len(c.Trace) == 0 && len(c.Schedule) == 0
+}
+
+// String describes the link briefly, without listing the trace
+func (c LinkConfig) String() string {
+	var fields []string
+	if len(c.Trace) > 0 {
+		fields = append(fields, fmt.Sprintf("trace=%d packets/%v (%d B/s)",
+			len(c.Trace), c.Trace[len(c.Trace)-1], c.rate()))
+	} else if c.Rate > 0 {
+		fields = append(fields, fmt.Sprintf("rate=%d B/s", c.Rate))
+	}
+	if c.Delay > 0 {
+		fields = append(fields, "delay="+c.Delay.String())
+	}
+	if c.Jitter > 0 {
+		fields = append(fields, "jitter="+c.Jitter.String())
+	}
+	if c.Loss > 0 {
+		fields = append(fields, fmt.Sprintf("loss=%g", c.Loss))
+	}
+	if c.Queue > 0 {
+		fields = append(fields, fmt.Sprintf("queue=%d", c.Queue))
+	}
+	if len(c.Schedule) > 0 {
+		fields = append(fields, fmt.Sprintf("schedule=%d steps", len(c.Schedule)))
+	}
+	if len(fields) == 0 {
+		return "unshaped"
+	}
+	return strings.Join(fields, " ")
+}
+
+// rate returns the bottleneck rate, which for a trace is its average
+func (c LinkConfig) rate() int64 {
+	if len(c.Trace) == 0 {
+		return c.Rate
+	}
+	return int64(len(c.Trace)) * linkMTU * int64(time.Second) / int64(c.Trace[len(c.Trace)-1])
+}
+
+// at returns the configuration in effect once elapsed has passed since setup
+func (c LinkConfig) at(elapsed time.Duration) LinkConfig {
+	if len(c.Schedule) == 0 {
+		return c
+	}
+	if c.Period > 0 {
+		elapsed %= c.Period
+	}
+	ret := c
+	for _, step := range c.Schedule {
+		if step.At > elapsed {
+			break
+		}
+		ret = step.Config
+	}
+	return ret
+}
+
+// parseTrace reads a mahimahi trace: one packet delivery opportunity per line, given as
+// milliseconds since the start, in non-decreasing order
+func parseTrace(r io.Reader) ([]time.Duration, error) {
+	var trace []time.Duration
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		ms, err := strconv.ParseUint(text, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad timestamp %q", line, text)
+		}
+		at := time.Duration(ms) * time.Millisecond
+		if len(trace) > 0 && at < trace[len(trace)-1] {
+			return nil, fmt.Errorf("line %d: timestamp %d goes back in time", line, ms)
+		}
+		trace = append(trace, at)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(trace) == 0 || trace[len(trace)-1] == 0 {
+		return nil, fmt.Errorf("trace must end after 0ms")
+	}
+	return trace, nil
+}
+
+// loadTrace reads a mahimahi trace file
+func loadTrace(name string) ([]time.Duration, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	trace, err := parseTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return trace, nil
+}
+
+type timedPacket struct {
+	data []byte    // nil marks the end of the data
+	at   time.Time // time of delivery
+}
+
+// shaper delays the data passing one direction of a link: every packet waits for the
+// bottleneck to serialize it at the link rate, then for the propagation delay.  As the
+// emulated link carries TCP, loss does not drop data but delays the packet by a
+// retransmission timeout, holding up everything behind it (head-of-line blocking).
+type shaper struct {
+	cfg         LinkConfig
+	start       time.Time // for the schedule of cfg
+	packets     chan timedPacket
+	done        chan struct{} // closed to abort delivery
+	drained     chan struct{} // closed when the delivery goroutine exits
+	nextFree    time.Time     // when the bottleneck can serialize the next packet
+	lastArrival time.Time     // deliveries stay in order
+	traceNext   int64         // delivery opportunities of the trace used up, over all repetitions
+	mux         sync.Mutex    // protects nextFree, lastArrival and traceNext
+}
+
+func newShaper(cfg LinkConfig, deliver func([]byte) error, onError func(error)) *shaper {
+	s := &shaper{
+		cfg:     cfg,
+		start:   time.Now(),
+		packets: make(chan timedPacket, 1024),
+		done:    make(chan struct{}),
+		drained: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.drained)
+		for {
+			var pkt timedPacket
+			select {
+			case pkt = <-s.packets:
+			case <-s.done:
+				return
+			}
+			if pkt.data == nil {
+				return
+			}
+			if wait := time.Until(pkt.at); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-s.done:
+					timer.Stop()
+					return
+				}
+			}
+			if err := deliver(pkt.data); err != nil {
+				onError(err)
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *shaper) enqueue(pkt timedPacket) {
+	select {
+	case s.packets <- pkt:
+	case <-s.done:
+	case <-s.drained:
+	}
+}
+
+// send queues p for delivery, cutting it into packets
+func (s *shaper) send(p []byte) {
+	for len(p) > 0 {
+		n := len(p)
+		if n > linkMTU {
+			n = linkMTU
+		}
+		data := make([]byte, n)
+		copy(data, p[:n])
+		p = p[n:]
+
+		s.mux.Lock()
+		now := time.Now()
+		if s.nextFree.Before(now) {
+			s.nextFree = now
+		}
+		// the packet sees the link as it is when its serialization starts
+		cfg := s.cfg.at(s.nextFree.Sub(s.start))
+		if rate := cfg.rate(); cfg.Queue > 0 && rate > 0 {
+			// wait for the bottleneck buffer to drain below the limit
+			backlog := s.nextFree.Sub(now)
+			if excess := backlog - time.Duration((cfg.Queue-int64(n))*int64(time.Second)/rate); excess > 0 {
+				s.mux.Unlock()
+				time.Sleep(excess)
+				s.mux.Lock()
+				now = time.Now()
+				if s.nextFree.Before(now) {
+					s.nextFree = now
+				}
+			}
+		}
+		if len(cfg.Trace) > 0 {
+			s.nextFree = s.traceSlot(cfg.Trace, s.nextFree)
+		} else if cfg.Rate > 0 {
+			s.nextFree = s.nextFree.Add(time.Duration(int64(n) * int64(time.Second) / cfg.Rate))
+		}
+		at := s.nextFree.Add(cfg.Delay)
+		if cfg.Jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(cfg.Jitter))))
+		}
+		if cfg.Loss > 0 && rand.Float64() < cfg.Loss {
+			at = at.Add(linkMinRTO + 2*cfg.Delay)
+		}
+		if at.Before(s.lastArrival) {
+			at = s.lastArrival
+		}
+		s.lastArrival = at
+		s.mux.Unlock()
+
+		s.enqueue(timedPacket{data: data, at: at})
+	}
+}
+
+// traceSlot takes the first unused delivery opportunity of trace at or after from, and
+// returns its time
+func (s *shaper) traceSlot(trace []time.Duration, from time.Time) time.Time {
+	n := int64(len(trace))
+	period := trace[n-1]
+	elapsed := from.Sub(s.start)
+	loops := int64(elapsed / period)
+	offset := elapsed - time.Duration(loops)*period
+	k := loops*n + int64(sort.Search(len(trace), func(i int) bool { return trace[i] >= offset }))
+	if k < s.traceNext {
+		k = s.traceNext
+	}
+	s.traceNext = k + 1
+	return s.start.Add(time.Duration(k/n)*period + trace[k%n])
+}
+
+// finish lets everything queued be delivered, then stops the shaper
+func (s *shaper) finish() {
+	s.enqueue(timedPacket{})
+	<-s.drained
+}
+
+// stop aborts delivery of everything still queued
+func (s *shaper) stop() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// linkConn is a net.Conn whose both directions pass an emulated link
+type linkConn struct {
+	net.Conn
+	down, up *shaper
+	pr       *io.PipeReader
+	pw       *io.PipeWriter
+	err      error      // sticky write error
+	mux      sync.Mutex // protects err
+}
+
+// newLinkConn wraps c, shaping what is written to it with down and what is read from it
+// with up (as seen from a server).
+func newLinkConn(c net.Conn, down, up LinkConfig) *linkConn {
+	lc := &linkConn{Conn: c}
+	lc.pr, lc.pw = io.Pipe()
+	lc.down = newShaper(down, func(p []byte) error {
+		_, err := c.Write(p)
+		return err
+	}, lc.setErr)
+	lc.up = newShaper(up, func(p []byte) error {
+		_, err := lc.pw.Write(p)
+		return err
+	}, func(err error) {})
+	go func() {
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := c.Read(buf)
+			if n > 0 {
+				lc.up.send(buf[:n])
+			}
+			if err != nil {
+				// the error comes after what is still on the link
+				lc.up.finish()
+				lc.pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return lc
+}
+
+func (lc *linkConn) setErr(err error) {
+	lc.mux.Lock()
+	defer lc.mux.Unlock()
+	if lc.err == nil {
+		lc.err = err
+	}
+}
+
+func (lc *linkConn) Read(p []byte) (int, error) {
+	return lc.pr.Read(p)
+}
+
+func (lc *linkConn) Write(p []byte) (int, error) {
+	lc.mux.Lock()
+	err := lc.err
+	lc.mux.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	lc.down.send(p)
+	return len(p), nil
+}
+
+func (lc *linkConn) Close() error {
+	lc.setErr(io.ErrClosedPipe)
+	lc.up.stop()
+	lc.pr.Close()
+	// like with TCP, what is already on the link still arrives
+	go func() {
+		lc.down.finish()
+		lc.Conn.Close()
+	}()
+	return nil
+}
+
+// linkListener wraps every accepted connection into an emulated link
+type linkListener struct {
+	net.Listener
+	down, up LinkConfig
+}
+
+func (l *linkListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newLinkConn(c, l.down, l.up), nil
+}
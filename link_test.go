@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// linkPair returns both ends of a TCP connection over loopback, the server end wrapped
+// into an emulated link
+func linkPair(t *testing.T, down, up LinkConfig) (server, client net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ll := &linkListener{Listener: l, down: down, up: up}
+	accepted := make(chan net.Conn)
+	go func() {
+		c, err := ll.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-accepted, client
+}
+
+// timeTransfer writes n bytes to w and returns how long it took r to read all of them
+func timeTransfer(t *testing.T, w io.Writer, r io.Reader, n int) time.Duration {
+	start := time.Now()
+	go func() {
+		if _, err := w.Write(make([]byte, n)); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err := io.ReadFull(r, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func checkDuration(t *testing.T, what string, got, min, max time.Duration) {
+	t.Helper()
+	if got < min || got > max {
+		t.Errorf("%s took %v, want between %v and %v", what, got, min, max)
+	}
+}
+
+func TestLinkRate(t *testing.T) {
+	server, client := linkPair(t, LinkConfig{Rate: 1 << 20}, LinkConfig{})
+	defer server.Close()
+	defer client.Close()
+	// 512KiB at 1MiB/s
+	checkDuration(t, "transfer", timeTransfer(t, server, client, 512<<10),
+		500*time.Millisecond, 800*time.Millisecond)
+}
+
+func TestLinkDelay(t *testing.T) {
+	server, client := linkPair(t, LinkConfig{Delay: 50 * time.Millisecond},
+		LinkConfig{Delay: 30 * time.Millisecond})
+	defer server.Close()
+	defer client.Close()
+	checkDuration(t, "downlink", timeTransfer(t, server, client, 100),
+		50*time.Millisecond, 100*time.Millisecond)
+	checkDuration(t, "uplink", timeTransfer(t, client, server, 100),
+		30*time.Millisecond, 80*time.Millisecond)
+}
+
+func TestLinkQueueLimit(t *testing.T) {
+	server, client := linkPair(t, LinkConfig{Rate: 1 << 20, Queue: 64 << 10}, LinkConfig{})
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+	// the writer is held back until all but the last 64KiB have left the bottleneck
+	start := time.Now()
+	if _, err := server.Write(make([]byte, 320<<10)); err != nil {
+		t.Fatal(err)
+	}
+	checkDuration(t, "write", time.Since(start), 200*time.Millisecond, 400*time.Millisecond)
+}
+
+func TestLinkSchedule(t *testing.T) {
+	link := LinkConfig{
+		Schedule: []LinkStep{
+			{At: 0, Config: LinkConfig{Rate: 256 << 10}},
+			{At: 100 * time.Millisecond, Config: LinkConfig{Rate: 4 << 20}},
+		},
+		Period: time.Hour,
+	}
+	if got := link.at(50 * time.Millisecond).Rate; got != 256<<10 {
+		t.Errorf("rate at 50ms = %d", got)
+	}
+	if got := link.at(time.Hour + 150*time.Millisecond).Rate; got != 4<<20 {
+		t.Errorf("rate at 1h150ms = %d", got)
+	}
+
+	server, client := linkPair(t, link, LinkConfig{})
+	defer server.Close()
+	defer client.Close()
+	// the first 100ms pass 25.6KiB, the rest of 1MiB goes at 4MiB/s
+	checkDuration(t, "transfer", timeTransfer(t, server, client, 1<<20),
+		330*time.Millisecond, 600*time.Millisecond)
+}
+
+func TestParseTrace(t *testing.T) {
+	trace, err := parseTrace(strings.NewReader("0\n2\n2\n\n5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{0, 2 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond}
+	if !reflect.DeepEqual(trace, want) {
+		t.Errorf("parseTrace = %v, want %v", trace, want)
+	}
+	for _, bad := range []string{"", "0\n", "3\n2\n", "1.5\n"} {
+		if _, err := parseTrace(strings.NewReader(bad)); err == nil {
+			t.Errorf("trace %q accepted", bad)
+		}
+	}
+}
+
+func TestLinkTrace(t *testing.T) {
+	// two packets per millisecond, except for an outage from 300ms to 600ms
+	trace, err := loadTrace(filepath.Join(testdata, "outage.trace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := linkPair(t, LinkConfig{Trace: trace}, LinkConfig{})
+	defer server.Close()
+	defer client.Close()
+	// 600 packets before the outage, 200 after it, so the last one leaves at 700ms after
+	// the link was set up
+	checkDuration(t, "transfer", timeTransfer(t, server, client, 800*linkMTU),
+		650*time.Millisecond, 850*time.Millisecond)
+}
+
+func TestParseListenSpec(t *testing.T) {
+	l, err := parseListenSpec("h2c://:8080,rate=8mbit,uprate=1MB,delay=20ms,jitter=2ms,loss=1%,queue=65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := listenSpec{
+		addr: ":8080",
+		h2c:  true,
+		down: LinkConfig{Rate: 1e6, Delay: 20 * time.Millisecond, Jitter: 2 * time.Millisecond,
+			Loss: 0.01, Queue: 65536},
+		up: LinkConfig{Rate: 1e6, Delay: 20 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("parseListenSpec = %+v, want %+v", l, want)
+	}
+	if _, err := parseListenSpec(":8080,rate=fast"); err == nil {
+		t.Error("bad rate accepted")
+	}
+
+	l, err = parseListenSpec(":8080,trace=" + filepath.Join(testdata, "steady.trace") + ",delay=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.down.Trace) != 1000 || len(l.up.Trace) != 0 || l.down.rate() != 1500000 {
+		t.Errorf("trace=steady.trace gives %v, up %v", l.down, l.up)
+	}
+}
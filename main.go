@@ -12,96 +12,312 @@ import (
 const (
 	serverCount    = 3
 	requestTimeout = 5 * time.Second
-	plotFile       = "plot.gnu"
-	plotWidth      = 800
-	plotHeight     = 600
 )
 
 var args struct {
-	Path        string   `arg:"-t" arg:"required" help:"the absolute file path on the CDN server" placeholder:"<file>"`
-	OutFilename string   `arg:"-o" arg:"required" help:"save the download to <file>" placeholder:"<file>"`
-	Servers     []string `arg:"positional" arg:"required"`
+	Path           string        `arg:"-t" arg:"required" help:"the absolute file path on the CDN server" placeholder:"<file>"`
+	OutFilename    string        `arg:"-o" arg:"required" help:"save the download to <file>" placeholder:"<file>"`
+	Servers        []string      `arg:"positional" arg:"required"`
+	Batch          string        `arg:"-b" help:"download every file listed in <manifest> over the same connections" placeholder:"<manifest>"`
+	Concurrency    int           `arg:"-j" help:"number of files of a batch downloaded at the same time" placeholder:"<n>"`
+	MultiRange     bool          `help:"fetch small fragments with one multi-range request per path"`
+	Scheduler      string        `help:"how ranges are spread across the paths: proportional, equal or static" placeholder:"<name>"`
+	Events         string        `help:"log connections, samples, splits and chokes to <file> as JSON lines" placeholder:"<file>"`
+	Report         string        `help:"render the run as an HTML page with charts to <file>" placeholder:"<file>"`
+	NoProgress     bool          `help:"do not show the progress of the download"`
+	Metrics        string        `help:"serve Prometheus metrics of the paths and downloads at http://<addr>/metrics" placeholder:"<addr>"`
+	Qlog           string        `help:"trace the HTTP/2 frames and flow control windows of each path to <dir>/path<n>.qlog" placeholder:"<dir>"`
+	AdaptiveWindow bool          `help:"grow the HTTP/2 receive windows of each path after its bandwidth-delay product, from 64KB, instead of opening 4MB per stream"`
+	MaxWindow      uint32        `help:"cap the windows grown with --adaptivewindow, which it requires, to <bytes>, per stream and per connection (default 16MB)" placeholder:"<bytes>"`
+	Pull           bool          `help:"grant the server the ranges split across the paths as they are received, a few RTTs ahead, rather than a whole window"`
+	Rtt            string        `help:"where the RTT of the paths comes from: ping (HTTP/2 PING frames) or tcpinfo (the kernel, on linux); with --events or --report, both are logged" placeholder:"<source>"`
+	RttMargin      float64       `help:"take the RTT of a path as the smoothed RTT plus <k> times its variation when choking, trading the bytes fetched twice for the idle time at the end" placeholder:"<k>"`
+	Warmup         int           `help:"split the first <bytes> of a download equally across the paths to measure them, then the rest after their rates, instead of splitting it all equally" placeholder:"<bytes>"`
+	NoPathCache    bool          `help:"neither start from the rates and RTTs of the paths learned in past runs nor remember them; by default every run reads and rewrites paths.json in the mphttp directory of the user cache"`
+	Estimator      string        `help:"how the rate of a path is estimated from its samples: mean, ewma, max or harmonic" placeholder:"<name>"`
+	BwInterval     time.Duration `help:"interval of the rate samples, a multiple of 1ms" placeholder:"<duration>"`
 }
 
-func main() {
-	p := arg.MustParse(&args)
-	if len(args.Servers) != 3 {
-		p.Fail("must provide exactly 3 servers")
+// subcommands are dispatched on the first argument; without one, mphttp downloads a
+// single file (or a batch of them)
+var subcommands = map[string]func(args []string){
+	"mirror": mirrorMain,
+	"upload": uploadMain,
+	"serve":  serveMain,
+	"bench":  benchMain,
+	"sim":    simMain,
+}
+
+// mustParseSubcommand is arg.MustParse for the arguments following a subcommand
+func mustParseSubcommand(name string, dest interface{}, args []string) *arg.Parser {
+	p, err := arg.NewParser(arg.Config{Program: "mphttp " + name}, dest)
+	fatal("argument parser for "+name, err)
+	switch err := p.Parse(args); {
+	case err == arg.ErrHelp:
+		p.WriteHelp(os.Stdout)
+		os.Exit(0)
+	case err != nil:
+		p.Fail(err.Error())
 	}
-	// append 443 (https port) to unspecified servers
-	for i := range args.Servers {
-		if strings.Index(args.Servers[i], ":") < 0 {
-			args.Servers[i] += ":443"
+	return p
+}
+
+// normalizeServers appends 443 (https port), or 80 for h2c, to servers without a port
+func normalizeServers(servers []string) {
+	for i := range servers {
+		if addr := strings.TrimPrefix(servers[i], h2cPrefix); strings.Index(addr, ":") < 0 {
+			if addr == servers[i] {
+				servers[i] += ":443"
+			} else {
+				servers[i] += ":80"
+			}
 		}
 	}
+}
 
-	// open output file, exit on failure
-	outFile, err := os.OpenFile(args.OutFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	fatal("open file", err)
-	defer outFile.Close()
+// downloadResult describes a finished download
+type downloadResult struct {
+	Length   int
+	Sum      [sha256.Size]byte
+	Duration time.Duration // since globalStart
+	Stats    []connStats   // in the order of the servers
+}
 
+// download fetches path from servers into outFile with the multipath engine, connecting
+// to all servers concurrently with the first request.
+func download(path string, servers []string, outFile *os.File) (res downloadResult) {
 	// start all 3 connections
 	// range: bytes=0- for Content-Range in response
 	globalStart = time.Now()
-	fullReq := LeftRangedGet(args.Path, 0)
-	connCh := make(chan MonitoredMpConn, serverCount)
-	respCh := make(chan responseStream, serverCount)
-	for i := 0; i < serverCount; i++ {
+	logEstimator()
+	fullReq := LeftRangedGet(path, 0)
+	type connected struct {
+		server int
+		conn   MonitoredMpConn
+		rs     responseStream
+	}
+	connCh := make(chan connected, len(servers))
+	for i := 0; i < len(servers); i++ {
 		go func(i int) {
-			conn := NewMonitoredMpConn(args.Servers[i])
-			// fill response first so conn and resp are in the same order
-			respCh <- conn.StartRequest(fullReq)
-			connCh <- conn
+			conn := NewMonitoredMpConn(servers[i], i)
+			progress.addPath(conn)
+			metrics.addPath(conn)
+			var rs responseStream
+			if pullStreams {
+				// pulled by nSplitRequest; the spare ones cost no more than their credit
+				// until they are closed
+				rs = conn.StartPullRequest(fullReq, pullMinAhead)
+			} else {
+				rs = conn.StartRequest(fullReq)
+			}
+			connCh <- connected{server: i, conn: conn, rs: rs}
 		}(i)
 	}
 
-	resps, conns := make([]responseStream, serverCount), make([]MonitoredMpConn, serverCount)
-	connsReady := make([]chan struct{}, serverCount)
+	resps, conns := make([]responseStream, len(servers)), make([]MonitoredMpConn, len(servers))
+	order := make([]int, len(servers))
+	connsReady := make([]chan struct{}, len(servers))
 	for idx := range connsReady {
 		connsReady[idx] = make(chan struct{})
 	}
-	for i := 0; i < serverCount; i++ {
-		go func(i int) {
-			resps[i], conns[i] = <-respCh, <-connCh
+	go func() {
+		for i := 0; i < len(servers); i++ {
+			c := <-connCh
+			resps[i], conns[i], order[i] = c.rs, c.conn, c.server
+			logEvent("ready", c.server, nil)
 			close(connsReady[i])
-		}(i)
-	}
+		}
+	}()
 	// resps and conns are sorted in order of earlier completion
 
 	<-connsReady[0]
 	response := resps[0].response
 	length := getTotalLength(response)
-	fmt.Printf("Total length: %d\n", length)
-
-	buf := make([]byte, length)
-	nSplitRequest(args.Path, conns, connsReady, nil, 0, length, buf, &resps[0])
-	duration := time.Since(globalStart)
+	// only the first response is used, streamed or as the first range: the others would
+	// keep their paths busy with the start of the resource
+	closeSpareResponses(resps, connsReady)
+	if length == unknownLength {
+		logf("Total length unknown, streaming\n")
+		if pullStreams && resps[0].stream != nil {
+			fatal("unpull", resps[0].stream.Unpull())
+		}
+		length = streamRequest(path, conns, connsReady, &resps[0], outFile)
+		res.Duration = time.Since(globalStart)
+		logf("Stream finished, total length: %d\n", length)
+		res.Sum = hashFile(outFile)
+	} else {
+		logf("Total length: %d\n", length)
+		progress.expect(length)
 
-	fmt.Printf("Download finished, writing output...")
-	start := time.Now()
-	_, err = outFile.Write(buf)
-	fmt.Printf("took %v.\n", time.Since(start))
-	fatal("write", err)
+		buf := make([]byte, length)
+		// the paths known from past runs need no warm-up
+		bw := cachedCounters(conns, connsReady)
+		if bw == nil && warmsUp(length) {
+			bw = warmup(path, conns, connsReady, rangeBuf{b: buf}, &resps[0])
+			bw = nSplitRequest(path, conns, connsReady, bw, warmupBytes, length, rangeBuf{b: buf}, nil)
+		} else {
+			if bw == nil {
+				bw = newBwCounters(conns, connsReady)
+			}
+			bw = nSplitRequest(path, conns, connsReady, bw, 0, length, rangeBuf{b: buf}, &resps[0])
+		}
+		rememberPaths(conns, bw)
+		res.Duration = time.Since(globalStart)
 
-	fmt.Printf("%s (sha256 %x) %v\n", args.OutFilename,
-		sha256.Sum256(buf), duration)
+		start := time.Now()
+		_, err := outFile.Write(buf)
+		fatal("write", err)
+		logf("Download finished, output written in %v\n", time.Since(start))
+		res.Sum = sha256.Sum256(buf)
+	}
+	res.Length = length
+	logEvent("download", -1, eventFields{"url": path, "length": length, "duration": msec(res.Duration)})
 
-	for idx := range connDataMap.m {
-		connDataMap.m[idx].Close()
+	res.Stats = make([]connStats, len(servers))
+	for idx := range conns {
+		<-connsReady[idx]
+		res.Stats[order[idx]] = conns[idx].Stats()
 		conns[idx].Close()
 	}
+	return
+}
+
+// closeSpareResponses closes the full responses of all paths but the first to be ready,
+// as soon as each is ready
+func closeSpareResponses(resps []responseStream, connsReady []chan struct{}) {
+	for i := 1; i < len(resps); i++ {
+		go func(i int) {
+			<-connsReady[i]
+			if resps[i].response != nil {
+				resps[i].response.Body.Close()
+			}
+		}(i)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	args.Concurrency = 2
+	args.Scheduler = "proportional"
+	args.Rtt = "ping"
+	args.Estimator = "mean"
+	args.BwInterval = bwSampleInterval
+	p := arg.MustParse(&args)
+	if len(args.Servers) != serverCount {
+		p.Fail("must provide exactly 3 servers")
+	}
+	normalizeServers(args.Servers)
+	multiRange = args.MultiRange
+	var ok bool
+	if scheduler, ok = schedulers[args.Scheduler]; !ok {
+		p.Fail("unknown scheduler " + args.Scheduler + "; known: " + schedulerNames())
+	}
+	if args.Events != "" {
+		var err error
+		events, err = createEventLog(args.Events)
+		fatal("event log", err)
+		defer func() {
+			fatal("event log", events.Close())
+		}()
+	}
+	qlogDir = args.Qlog
+	if args.MaxWindow != 0 && !args.AdaptiveWindow {
+		// the fixed windows are not grown, so there is nothing to cap
+		p.Fail("--maxwindow needs --adaptivewindow")
+	}
+	adaptiveWindow, maxWindow = args.AdaptiveWindow, args.MaxWindow
+	pullStreams = args.Pull
+	if args.Warmup != 0 && args.Warmup < minWarmupBytes {
+		p.Fail(fmt.Sprintf("--warmup must be 0 or at least %d bytes", minWarmupBytes))
+	}
+	warmupBytes = args.Warmup
+	switch args.Rtt {
+	case "ping":
+	case "tcpinfo":
+		if !tcpInfoSupported {
+			p.Fail("--rtt tcpinfo is only supported on linux")
+		}
+	default:
+		p.Fail("unknown RTT source " + args.Rtt + "; known: ping, tcpinfo")
+	}
+	rttSource = args.Rtt
+	if args.RttMargin < 0 {
+		p.Fail("--rttmargin must not be negative")
+	}
+	rttMargin = args.RttMargin
+	if _, ok := estimators[args.Estimator]; !ok {
+		p.Fail("unknown estimator " + args.Estimator + "; known: " + estimatorNames())
+	}
+	estimatorName = args.Estimator
+	if args.BwInterval <= 0 || args.BwInterval%time.Millisecond != 0 {
+		p.Fail("--bwinterval must be a positive multiple of 1ms")
+	}
+	bwSampleInterval = args.BwInterval
+	if !args.NoPathCache {
+		pathCacheFile = defaultPathCacheFile()
+		pathProfiles = loadPathCache(pathCacheFile)
+	}
+	if args.Report != "" {
+		report = &reportRecorder{}
+	}
+	if !args.NoProgress {
+		progress = newProgressDisplay(os.Stdout)
+	}
+	startMetrics(args.Metrics)
+
+	if args.Batch != "" {
+		jobs := readBatchManifest(args.Batch)
+		globalStart = time.Now()
+		logEstimator()
+		s := newSession(args.Servers)
+		runBatch(s, jobs, args.Concurrency)
+		rememberPaths(s.conns, s.warmCounters())
+		progress.Stop()
+		duration := time.Since(globalStart)
+		fmt.Printf("Batch of %d files finished in %v\n", len(jobs), duration)
+		s.Close()
+		writeReport(fmt.Sprintf("batch of %d files", len(jobs)), duration)
+		return
+	}
+	if args.Path == "" || args.OutFilename == "" {
+		p.Fail("must provide --path and --outfilename, or --batch")
+	}
 
-	fmt.Printf("Writing %s...", plotFile)
-	plotF, err := os.OpenFile(plotFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	defer plotF.Close()
-	fatal("plot file", err)
-	fmt.Fprintf(plotF, `set terminal png transparent enhanced font "arial,10" fontscale 1.0 size %d, %d
-set output 'gnuplot.png'
-set style increment default
-set style data lines
-set xlabel 'time elapsed (ms)'
-set ylabel 'byte range (Kb)'
-plot [0:%d][0:%d] "0.dat" title '0' with points, "1.dat" title '1' with points, "2.dat" title '2' with points`,
-		plotWidth, plotHeight, int64(duration / time.Millisecond), length)
-	fmt.Printf("...done\n")
+	// open output file, exit on failure
+	outFile, err := os.OpenFile(args.OutFilename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	fatal("open file", err)
+	defer outFile.Close()
+
+	res := download(args.Path, args.Servers, outFile)
+	progress.Stop()
+	fmt.Printf("%s (sha256 %x) %v\n", args.OutFilename, res.Sum, res.Duration)
+	writeReport(fmt.Sprintf("%s (%d bytes)", args.Path, res.Length), res.Duration)
+}
+
+// startMetrics exports the metrics at addr, if not empty
+func startMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	metrics = newMetricsExporter()
+	fatal("metrics", serveMetrics(addr, metrics))
+}
+
+// writeReport renders the --report page of the run, if enabled
+func writeReport(title string, duration time.Duration) {
+	if report == nil {
+		return
+	}
+	fmt.Printf("Writing %s...", args.Report)
+	f, err := os.Create(args.Report)
+	fatal("report file", err)
+	defer f.Close()
+	fatal("write report", report.writeHTML(f, title, duration))
+	fmt.Printf("done\n")
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// metricsExporter serves the state of the paths and the downloads for Prometheus.  The
+// byte counts come from the connections, the rates from the BwCounter of the streams in
+// flight and the RTT from the rttMonitor, all read when scraped; only what happens in
+// events (chokes, duplicates, finished downloads) is counted here.  The methods do
+// nothing on a nil exporter.
+//
+// There are no failovers to export: a range whose request fails is not moved to another
+// path, which is fatal but in the races of short ranges, where the other paths fetch it
+// anyway.  The requests that failed are exported instead, as
+// mphttp_path_request_failures_total.
+type metricsExporter struct {
+	conns      []*MonitoredMpConn // by path; nil until connected
+	streams    map[*metricsStream]bool
+	chokes     []int64 // by path
+	duplicated []int64 // by path
+	durations  histogram
+	sizes      histogram
+	mux        sync.Mutex // protects all above
+}
+
+type metricsStream struct {
+	path    int
+	counter *BwCounter
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	bounds []float64 // upper bounds, increasing; +Inf is implied
+	counts []int64   // per bound, and one more for +Inf; not cumulative
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) histogram {
+	return histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+}
+
+// metrics is the exporter of --metrics; nil if disabled
+var metrics *metricsExporter
+
+func newMetricsExporter() *metricsExporter {
+	return &metricsExporter{
+		streams:   map[*metricsStream]bool{},
+		durations: newHistogram(0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300),
+		sizes:     newHistogram(1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10),
+	}
+}
+
+// serveMetrics exports the metrics at /metrics on addr until the process exits
+func serveMetrics(addr string, m *metricsExporter) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		log.Print("metrics: ", http.Serve(l, mux))
+	}()
+	return nil
+}
+
+// addPath exports conn, which must be connected
+func (m *metricsExporter) addPath(conn MonitoredMpConn) {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for len(m.conns) <= conn.path {
+		m.conns = append(m.conns, nil)
+		m.chokes = append(m.chokes, 0)
+		m.duplicated = append(m.duplicated, 0)
+	}
+	m.conns[conn.path] = &conn
+}
+
+// stream counts a stream in flight on path, its rate measured by counter, until the
+// returned function is called
+func (m *metricsExporter) stream(path int, counter *BwCounter) func() {
+	if m == nil {
+		return func() {}
+	}
+	st := &metricsStream{path: path, counter: counter}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.streams[st] = true
+	return func() {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		delete(m.streams, st)
+	}
+}
+
+// event counts the chokes, duplicates and downloads logged with logEvent
+func (m *metricsExporter) event(kind string, path int, fields eventFields) {
+	e := reportEvent{kind: kind, path: path, fields: fields}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	switch kind {
+	case "choke", "duplicate":
+		if path < 0 || path >= len(m.conns) {
+			return
+		}
+		if kind == "choke" {
+			m.chokes[path]++
+		} else {
+			m.duplicated[path] += int64(e.field("bytes"))
+		}
+	case "download":
+		m.durations.observe(e.field("duration") / 1e3)
+		m.sizes.observe(e.field("length"))
+	}
+}
+
+// openMetricsType is the content type of the OpenMetrics text format, served when the
+// scraper accepts it; the Prometheus text format otherwise
+const openMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+func (m *metricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsType)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	m.write(w, openMetrics)
+}
+
+// write writes the metrics in the Prometheus text format, or in OpenMetrics, which
+// names counter families without _total and ends with # EOF
+func (m *metricsExporter) write(w io.Writer, openMetrics bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	family := func(name, typ, help string) {
+		if openMetrics && typ == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	// one sample per connected path
+	perPath := func(name, typ, help string, value func(path int, conn *MonitoredMpConn) float64) {
+		family(name, typ, help)
+		for path, conn := range m.conns {
+			if conn != nil {
+				fmt.Fprintf(w, "%s{path=\"%d\"} %v\n", name, path, value(path, conn))
+			}
+		}
+	}
+
+	perPath("mphttp_path_received_bytes_total", "counter",
+		"Bytes read off the connection, including HTTP/2 framing.",
+		func(path int, conn *MonitoredMpConn) float64 { return float64(conn.Stats().Wire) })
+	perPath("mphttp_path_body_bytes_total", "counter", "Bytes read from response bodies.",
+		func(path int, conn *MonitoredMpConn) float64 { return float64(conn.Stats().Body) })
+	perPath("mphttp_path_wasted_bytes_total", "counter",
+		"Bytes of response bodies received but never read: past choke points, or of responses closed early.",
+		func(path int, conn *MonitoredMpConn) float64 {
+			stats := conn.Stats()
+			return float64(stats.Data - stats.Body)
+		})
+	perPath("mphttp_path_duplicated_bytes_total", "counter",
+		"Body bytes also fetched on another path, after a race or a refragmentation without choke.",
+		func(path int, conn *MonitoredMpConn) float64 { return float64(m.duplicated[path]) })
+	perPath("mphttp_path_rate_bytes_per_second", "gauge",
+		"Rate estimated by the streams in flight on the path.",
+		func(path int, conn *MonitoredMpConn) float64 {
+			var rate int64
+			for st := range m.streams {
+				if st.path == path {
+					rate += st.counter.Rate()
+				}
+			}
+			return float64(rate)
+		})
+	perPath("mphttp_path_rtt_seconds", "gauge", "Smoothed RTT of the path.",
+		func(path int, conn *MonitoredMpConn) float64 { return conn.MeasureRtt().Seconds() })
+	perPath("mphttp_path_rttvar_seconds", "gauge", "Variation of the RTT of the path.",
+		func(path int, conn *MonitoredMpConn) float64 { return conn.mon.GetRttVar().Seconds() })
+	perPath("mphttp_path_min_rtt_seconds", "gauge", "Lowest RTT of the path.",
+		func(path int, conn *MonitoredMpConn) float64 { return conn.mon.GetMinRtt().Seconds() })
+	perPath("mphttp_path_active_streams", "gauge", "Response bodies being read on the path.",
+		func(path int, conn *MonitoredMpConn) float64 {
+			n := 0
+			for st := range m.streams {
+				if st.path == path {
+					n++
+				}
+			}
+			return float64(n)
+		})
+	perPath("mphttp_path_chokes_total", "counter", "Streams choked on the path.",
+		func(path int, conn *MonitoredMpConn) float64 { return float64(m.chokes[path]) })
+	perPath("mphttp_path_stream_resets_total", "counter",
+		"Response bodies closed before their end, resetting the stream with RST_STREAM.",
+		func(path int, conn *MonitoredMpConn) float64 { return float64(conn.Stats().Resets) })
+	perPath("mphttp_path_request_failures_total", "counter",
+		"Requests that failed on the path without a response.",
+		func(path int, conn *MonitoredMpConn) float64 { return float64(conn.Stats().Failures) })
+
+	writeHistogram := func(name, help string, h histogram) {
+		family(name, "histogram", help)
+		var cumulative int64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", name, bound, cumulative)
+		}
+		cumulative += h.counts[len(h.bounds)]
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %v\n%s_count %d\n",
+			name, cumulative, name, h.sum, name, cumulative)
+	}
+	writeHistogram("mphttp_download_duration_seconds", "Duration of the downloads.", m.durations)
+	writeHistogram("mphttp_download_size_bytes", "Size of the downloads.", m.sizes)
+
+	if openMetrics {
+		fmt.Fprintln(w, "# EOF")
+	}
+}
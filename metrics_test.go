@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(1, 10)
+	for _, v := range []float64{0.5, 1, 3, 20} {
+		h.observe(v)
+	}
+	if h.counts[0] != 2 || h.counts[1] != 1 || h.counts[2] != 1 || h.sum != 24.5 {
+		t.Errorf("histogram = %+v", h)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics = newMetricsExporter()
+	defer func() {
+		metrics = nil
+	}()
+	content := randomContent(2 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler,
+		LinkConfig{Rate: 2 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 2 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 2 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+	res := download("/content", servers, out)
+
+	scrape := func(accept string) (string, string) {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, req)
+		return rec.Header().Get("Content-Type"), rec.Body.String()
+	}
+	typ, body := scrape("*/*")
+	if !strings.HasPrefix(typ, "text/plain") {
+		t.Errorf("content type %q", typ)
+	}
+	for path, stats := range res.Stats {
+		for _, want := range []string{
+			fmt.Sprintf("mphttp_path_body_bytes_total{path=\"%d\"} %v", path, float64(stats.Body)),
+			fmt.Sprintf("mphttp_path_active_streams{path=\"%d\"} 0", path),
+		} {
+			if !strings.Contains(body, want+"\n") {
+				t.Errorf("metrics lack %q:\n%s", want, body)
+			}
+		}
+	}
+	for _, want := range []string{
+		"# TYPE mphttp_path_received_bytes_total counter\n",
+		"# TYPE mphttp_download_duration_seconds histogram\n",
+		"mphttp_download_size_bytes_bucket{le=\"1e+07\"} 1\n",
+		"mphttp_download_size_bytes_sum 2.097152e+06\n",
+		"mphttp_download_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+
+	typ, body = scrape("application/openmetrics-text; version=1.0.0,text/plain;q=0.5")
+	if typ != openMetricsType || !strings.HasSuffix(body, "# EOF\n") ||
+		!strings.Contains(body, "# TYPE mphttp_path_received_bytes counter\n") {
+		t.Errorf("OpenMetrics as %q:\n%s", typ, body)
+	}
+}
+
+func TestStreamResets(t *testing.T) {
+	content := randomContent(256 << 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler, LinkConfig{})
+	defer stop()
+	conn := NewMonitoredMpConn(servers[0], 0)
+	defer conn.Close()
+
+	// a body read up to its length is not reset, even without reading EOF
+	resp := conn.StartRequest(DoubleRangedGet("/content", 0, 1000)).response
+	if _, err := io.ReadFull(resp.Body, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resets := conn.Stats().Resets; resets != 0 {
+		t.Errorf("resets after a complete body = %d", resets)
+	}
+	// one closed halfway is
+	resp = conn.StartRequest(DoubleRangedGet("/content", 0, len(content))).response
+	if _, err := io.ReadFull(resp.Body, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resets := conn.Stats().Resets; resets != 1 {
+		t.Errorf("resets after a body closed halfway = %d", resets)
+	}
+}
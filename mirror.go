@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// mirrorStateFile keeps the ETags of mirrored files, relative to the output directory
+const mirrorStateFile = ".mphttp-mirror.json"
+
+var mirrorArgs struct {
+	Index       string   `arg:"-t,required" help:"URL or absolute path of the autoindex listing or JSON manifest" placeholder:"<url>"`
+	OutDir      string   `arg:"-o,required" help:"mirror into <dir>" placeholder:"<dir>"`
+	Concurrency int      `arg:"-j" help:"number of files downloaded at the same time" placeholder:"<n>"`
+	Metrics     string   `help:"serve Prometheus metrics of the paths and downloads at http://<addr>/metrics" placeholder:"<addr>"`
+	Servers     []string `arg:"positional,required"`
+}
+
+// mirrorEntry is an entry of a JSON manifest.  Both plain manifests ({"path": ...}) and
+// nginx's "autoindex_format json" listings ({"name": ..., "type": ...}) are understood;
+// sizes, ETags and mtimes are taken from the server when the files are stat'ed.
+type mirrorEntry struct {
+	Path string `json:"path"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// hrefPattern picks the links out of an autoindex HTML page
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+
+func mirrorMain(args []string) {
+	mirrorArgs.Concurrency = 2
+	p := mustParseSubcommand("mirror", &mirrorArgs, args)
+	if len(mirrorArgs.Servers) != serverCount {
+		p.Fail("must provide exactly 3 servers")
+	}
+	normalizeServers(mirrorArgs.Servers)
+
+	root, err := url.Parse(mirrorArgs.Index)
+	fatal("parse index URL", err)
+	if !strings.HasSuffix(root.Path, "/") {
+		// a manifest file: mirror what is next to it
+		root.Path = root.Path[:strings.LastIndex(root.Path, "/")+1]
+	}
+
+	startMetrics(mirrorArgs.Metrics)
+	globalStart = time.Now()
+	s := newSession(mirrorArgs.Servers)
+	defer s.Close()
+
+	jobs := listMirror(s, root, mirrorArgs.Index)
+	fmt.Printf("Found %d files\n", len(jobs))
+	s.statAll(jobs)
+
+	state := map[string]string{}
+	statePath := filepath.Join(mirrorArgs.OutDir, mirrorStateFile)
+	if content, err := ioutil.ReadFile(statePath); err == nil {
+		fatal("parse mirror state", json.Unmarshal(content, &state))
+	}
+	var pending []*batchJob
+	for _, job := range jobs {
+		if upToDate(job, state[mirrorKey(job)]) {
+			continue
+		}
+		pending = append(pending, job)
+	}
+	fmt.Printf("%d files up to date, fetching %d\n", len(jobs)-len(pending), len(pending))
+	s.runQueue(pending, mirrorArgs.Concurrency)
+
+	for _, job := range pending {
+		if job.etag != "" {
+			state[mirrorKey(job)] = job.etag
+		} else {
+			delete(state, mirrorKey(job))
+		}
+	}
+	fatal("create output directory", os.MkdirAll(mirrorArgs.OutDir, 0755))
+	content, err := json.MarshalIndent(state, "", "  ")
+	fatal("encode mirror state", err)
+	fatal("write mirror state", ioutil.WriteFile(statePath, content, 0644))
+	fmt.Printf("Mirror finished in %v\n", time.Since(globalStart))
+}
+
+// mirrorKey is the path of the job's output relative to the output directory
+func mirrorKey(job *batchJob) string {
+	rel, err := filepath.Rel(mirrorArgs.OutDir, job.Output)
+	fatal("relative output path", err)
+	return filepath.ToSlash(rel)
+}
+
+// upToDate tells if the local copy of a stat'ed job can be kept.  Sizes have to match,
+// and so do ETags if the server sends them; otherwise modification times are compared.
+func upToDate(job *batchJob, localETag string) bool {
+	info, err := os.Stat(job.Output)
+	if err != nil || job.length == unknownLength || info.Size() != int64(job.length) {
+		return false
+	}
+	if job.etag != "" {
+		return job.etag == localETag
+	}
+	return job.mtime.IsZero() || info.ModTime().Equal(job.mtime)
+}
+
+// mirrorOutput is where the file at rel, a slash-separated path relative to the root of
+// the listing, is mirrored to; false if it would be outside of the output directory
+func mirrorOutput(rel string) (string, bool) {
+	if rel == "" || path.IsAbs(rel) {
+		return "", false
+	}
+	for _, segment := range strings.Split(rel, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	dir := filepath.Clean(mirrorArgs.OutDir)
+	output := filepath.Join(dir, filepath.FromSlash(rel))
+	if inside, err := filepath.Rel(dir, output); err != nil || inside == ".." ||
+		strings.HasPrefix(inside, ".."+string(filepath.Separator)) || filepath.IsAbs(inside) {
+		return "", false
+	}
+	return output, true
+}
+
+// listMirror walks the listing at index recursively and returns a job for every file
+// below root, with outputs laid out the same way under the output directory.
+func listMirror(s *session, root *url.URL, index string) []*batchJob {
+	rs := s.conns[s.fastestConn()].StartRequest(UnrangedGet(index))
+	if rs.response == nil {
+		log.Fatalf("fetching listing %s failed", index)
+	}
+	body, err := ioutil.ReadAll(rs.response.Body)
+	rs.response.Body.Close()
+	fatal("read listing "+index, err)
+	if rs.response.StatusCode != http.StatusOK {
+		log.Fatalf("unexpected status code for listing %s: %d", index, rs.response.StatusCode)
+	}
+	base, err := url.Parse(index)
+	fatal("parse listing URL", err)
+
+	var jobs []*batchJob
+	add := func(ref string, dir bool) {
+		u, err := base.Parse(ref)
+		if err != nil || u.Host != root.Host || u.RawQuery != "" {
+			return
+		}
+		u.Fragment = ""
+		// Parse leaves the percent-encoded dot segments in the path
+		dir = dir || strings.HasSuffix(u.Path, "/")
+		u.Path, u.RawPath = path.Clean(u.Path), ""
+		if dir && !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		if !strings.HasPrefix(u.Path, root.Path) || u.Path == root.Path || u.Path == base.Path {
+			// parent directory, sorting links and the like
+			return
+		}
+		if dir {
+			jobs = append(jobs, listMirror(s, root, u.String())...)
+			return
+		}
+		output, ok := mirrorOutput(strings.TrimPrefix(u.Path, root.Path))
+		if !ok {
+			log.Printf("skipping %s: outside of the output directory", u)
+			return
+		}
+		jobs = append(jobs, &batchJob{
+			Path:   u.String(),
+			Output: output,
+		})
+	}
+
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		var entries []mirrorEntry
+		fatal("parse manifest "+index, json.Unmarshal(body, &entries))
+		for _, e := range entries {
+			ref := e.Path
+			if ref == "" {
+				ref = (&url.URL{Path: e.Name}).String()
+			}
+			add(ref, e.Type == "directory")
+		}
+	} else {
+		for _, m := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+			add(html.UnescapeString(m[1]), false)
+		}
+	}
+	return jobs
+}
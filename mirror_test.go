@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestListMirrorHostile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outDir := filepath.Join(dir, "out")
+	defer func(outDir string) { mirrorArgs.OutDir = outDir }(mirrorArgs.OutDir)
+	mirrorArgs.OutDir = outDir
+
+	listings := map[string]string{
+		"/pub/": `<a href="../">../</a>
+<a href="ok.bin">ok.bin</a>
+<a href="sub/">sub/</a>
+<a href="a/%2e%2e/%2e%2e/%2e%2e/etc/x">x</a>
+<a href="%2E%2E/%2e%2e/etc/y">y</a>
+<a href="a/..%2f..%2f..%2fetc/z">z</a>
+<a href="../../etc/passwd">passwd</a>
+<a href="/etc/shadow">shadow</a>
+<a href="a/%2e%2e/b.bin">b.bin</a>`,
+		"/pub/sub/": `<a href="x.bin">x.bin</a>
+<a href="%2e%2e/%2e%2e/sub.bin">sub.bin</a>
+<a href="%2e%2e/">up</a>`,
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listing, ok := listings[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(listing))
+	})
+	servers, stop := startServers(t, handler, LinkConfig{}, LinkConfig{}, LinkConfig{})
+	defer stop()
+	s := newSession(servers)
+	defer s.Close()
+
+	root, err := url.Parse("/pub/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outputs []string
+	for _, job := range listMirror(s, root, root.String()) {
+		if !strings.HasPrefix(job.Output, outDir+string(filepath.Separator)) {
+			t.Errorf("%s is mirrored to %s, outside of %s", job.Path, job.Output, outDir)
+		}
+		outputs = append(outputs, filepath.ToSlash(strings.TrimPrefix(job.Output, outDir)))
+	}
+	sort.Strings(outputs)
+	want := []string{"/b.bin", "/ok.bin", "/sub/x.bin"}
+	if strings.Join(outputs, " ") != strings.Join(want, " ") {
+		t.Errorf("mirrored %v, want %v", outputs, want)
+	}
+}
+
+func TestMirrorOutput(t *testing.T) {
+	defer func(outDir string) { mirrorArgs.OutDir = outDir }(mirrorArgs.OutDir)
+	mirrorArgs.OutDir = "out/"
+	for rel, want := range map[string]string{
+		"a.bin":        filepath.Join("out", "a.bin"),
+		"sub/a.bin":    filepath.Join("out", "sub", "a.bin"),
+		"":             "",
+		"/etc/x":       "",
+		"../x":         "",
+		"sub/../../x":  "",
+		"sub/../a.bin": "",
+	} {
+		if output, ok := mirrorOutput(rel); output != want || ok != (want != "") {
+			t.Errorf("mirrorOutput(%q) = %q, %v, want %q", rel, output, ok, want)
+		}
+	}
+}
@@ -6,25 +6,120 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"mphttp/dep/http2"
 )
 
 const (
 	minSplitSize = 4 << 10
-	// bwSampleInterval controls the interval of bandwidth estimation
-	// also the interval of graphing data output
-	bwSampleInterval = 10 * time.Millisecond
+	// minWarmupBytes is the least --warmup: a probe of minSplitSize per path, or they would
+	// be raced for without being measured
+	minWarmupBytes = 3 * minSplitSize
+	// pullMinAhead is the least a pulled stream is granted past what it received, and
+	// what it starts with
+	pullMinAhead = 256 << 10
 )
 
 // marks the time since download start; used for graphing
 var globalStart time.Time
 
+// bwSampleInterval controls the interval of bandwidth estimation, set with --bwinterval
+// also the interval of graphing data output
+var bwSampleInterval = 10 * time.Millisecond
+
+// warmupBytes is --warmup: how much of a download is split equally across the paths to
+// measure them, before the rest is split after their rates; 0 to split it all equally
+var warmupBytes int
+
+type contentRange struct {
+	start, end int
+}
+
+// rangeBuf holds the bytes of a file from offset on, which the ranges are read into
+type rangeBuf struct {
+	b      []byte
+	offset int
+}
+
+// slice is where the bytes of r go
+func (b rangeBuf) slice(r contentRange) []byte {
+	return b.b[r.start-b.offset : r.end-b.offset]
+}
+
+// splitRanges splits start-end into consecutive ranges, one per path, proportionally to
+// the rates of the paths.  Paths without rate data (all rates zero) get equal shares.
+func splitRanges(start, end int, rates []int64) []contentRange {
+	nConns := len(rates)
+	ranges := make([]contentRange, nConns)
+	singleSample := make([]int64, nConns)
+	var totalBw int64
+	for i, r := range rates {
+		singleSample[i] = r
+		totalBw += r
+	}
+	if totalBw == 0 {
+		splitSize := (end - start) / nConns
+		currStart := start
+		for idx := range ranges {
+			ranges[idx].start = currStart
+			ranges[idx].end = currStart + splitSize
+			currStart += splitSize
+		}
+		// handle non-divisible case
+		if r := (end - start) % nConns; r != 0 {
+			ranges[len(ranges)-1].end += r
+		}
+	} else {
+		// split according to scheduling algorithm
+		tot := int64(end - start)
+		var currSum int64
+		for i := range singleSample {
+			// round down, so no oversubscription; float64 keeps the shares of ranges
+			// below 2^53 exact to the byte
+			singleSample[i] = int64(float64(tot) * (float64(singleSample[i]) / float64(totalBw)))
+			if singleSample[i] > tot-currSum {
+				singleSample[i] = tot - currSum
+			}
+			currSum += singleSample[i]
+		}
+		singleSample[0] += tot - currSum
+		for id := range singleSample {
+			if singleSample[id] != 0 {
+				continue
+			}
+			biggestIdx := 0
+			for idx := range singleSample {
+				if singleSample[biggestIdx] < singleSample[idx] {
+					biggestIdx = idx
+				}
+			}
+			// steal one byte from the biggest split, unless it has no byte to spare
+			if singleSample[biggestIdx] > 1 {
+				singleSample[biggestIdx] -= 1
+				singleSample[id] += 1
+			}
+		}
+
+		currStart := start
+		for idx := range ranges {
+			ranges[idx].start = currStart
+			ranges[idx].end = currStart + int(singleSample[idx])
+			currStart += int(singleSample[idx])
+		}
+	}
+	return ranges
+}
+
 // if firstResponse != nil, that response will be used as the response for the first connection
 // at startup phase a response for the full content will be started to fetch length (we can save
 // 1 RTT by using GET instead of HEAD).  Pass that response as firstResponse.
 // if bw == nil, we do not have bandwidth data yet, so split equally
+// the counters with the latest measurements of the paths are returned: those of the deepest
+// fragment split last, or bw
 func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct{},
-	bw []*BwCounter, start int, end int, buf []byte, firstResponse *responseStream) {
+	bw []*BwCounter, start int, end int, buf rangeBuf, firstResponse *responseStream) []*BwCounter {
 	if start > end {
 		log.Panicf("nSplitRequest start=%d end=%d", start, end)
 	}
@@ -36,31 +131,48 @@ func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct
 		idx int
 		rs  responseStream
 	}
-	type contentRange struct {
-		start, end int
-	}
 	nConns := len(conns)
 	//fmt.Printf("start=%d end=%d\n", start, end)
 	if end-start < minSplitSize {
 		//fmt.Printf("Range %d-%d too short, stop splitting\n", start, end)
 		// issue on all connections, see who finishes first
-		bufChan := make(chan taggedBuf)
+		logEvent("race", -1, eventFields{"start": start, "end": end})
+		// buffered, so that the slower connections do not block after the winner is taken
+		bufChan := make(chan taggedBuf, nConns)
 		resps := make([]*http.Response, nConns)
+		raced := false          // the winner was taken: the responses are closed
+		var racedMux sync.Mutex // protects resps and raced
+		var won int32
 		for idx := range conns {
 			go func(idx int) {
-				req := DoubleRangedGet(url, start, end)
+				var resp *http.Response
 				if idx == 0 && firstResponse != nil {
-					resps[idx] = firstResponse.response
+					resp = firstResponse.response
 				} else {
 					<-connsReady[idx]
-					resps[idx] = conns[idx].StartRequest(req).response
+					resp = conns[idx].StartRequest(DoubleRangedGet(url, start, end)).response
+				}
+				if resp == nil {
+					// the connection failed or was closed after another one won
+					return
+				}
+				racedMux.Lock()
+				resps[idx] = resp
+				if raced {
+					resp.Body.Close()
 				}
-				buf := make([]byte, resps[idx].ContentLength)
-				_, err := io.ReadFull(resps[idx].Body, buf)
-				if err != nil {
+				racedMux.Unlock()
+				buf := make([]byte, end-start)
+				n, err := readRange(resp, contentRange{start, end}, buf)
+				if err != nil || !atomic.CompareAndSwapInt32(&won, 0, 1) {
 					//log.Printf("request on connection %d failed: %v\n", idx, err)
+					if n > 0 {
+						logEvent("duplicate", conns[idx].path, eventFields{"start": start, "end": start + n,
+							"bytes": n})
+					}
 					return
 				}
+				logEvent("complete", conns[idx].path, eventFields{"start": start, "end": end, "bytes": n})
 				bufChan <- taggedBuf{
 					idx: idx,
 					buf: buf,
@@ -69,6 +181,8 @@ func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct
 		}
 		firstFinish := <-bufChan
 		// close all other slow connections
+		racedMux.Lock()
+		raced = true
 		for i := 0; i < nConns; i++ {
 			if i != firstFinish.idx {
 				if resps[i] != nil {
@@ -76,73 +190,25 @@ func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct
 				}
 			}
 		}
-		copy(buf[start:end], firstFinish.buf)
-		return
+		racedMux.Unlock()
+		copy(buf.slice(contentRange{start, end}), firstFinish.buf)
+		progress.done(url, contentRange{start, end})
+		return bw
 	}
 
-	ranges := make([]contentRange, nConns)
-	if bw == nil {
-		splitSize := (end - start) / nConns
-		currStart := start
-		for idx := range ranges {
-			ranges[idx].start = currStart
-			ranges[idx].end = currStart + splitSize
-			currStart += splitSize
-		}
-		// handle non-divisible case
-		if r := (end - start) % nConns; r != 0 {
-			ranges[len(ranges)-1].end += r
-		}
-	} else {
-		// split according to scheduling algorithm
-		var totalBw int64
-		singleSample := make([]int64, nConns)
-		for i, b := range bw {
-			singleSample[i] = b.Rate()
-			totalBw += singleSample[i]
-		}
-		tot := end - start
-		var zeroIndices []int
-		for i := range singleSample {
-			// round down, so no oversubscription
-			singleSample[i] = int64(float32(tot) * (float32(singleSample[i]) / float32(totalBw)))
-			if singleSample[i] == 0 {
-				zeroIndices = append(zeroIndices, i)
-			}
-		}
-		var currSum int64
-		for _, d := range singleSample {
-			currSum += d
-		}
-		singleSample[0] += int64(end-start) - currSum
-		if len(zeroIndices) != 0 {
-			biggestIdx := 0
-			biggestSize := singleSample[0]
-			for idx := range singleSample {
-				if biggestSize < singleSample[idx] {
-					biggestSize = singleSample[idx]
-					biggestIdx = idx
-				}
-			}
-			for _, id := range zeroIndices {
-				// steal one byte from the biggest split
-				singleSample[biggestIdx] -= 1
-				singleSample[id] += 1
-			}
-		}
-
-		currStart := start
-		for idx := range ranges {
-			ranges[idx].start = currStart
-			ranges[idx].end = currStart + int(singleSample[idx])
-			currStart += int(singleSample[idx])
-		}
+	rates := make([]int64, nConns)
+	for i, b := range bw {
+		rates[i] = b.Rate()
 	}
-	fmt.Println(ranges)
+	ranges := scheduler.Split(start, end, rates)
+	logf("%v\n", ranges)
+	logEvent("split", -1, eventFields{"start": start, "end": end, "ranges": rangeList(ranges)})
 
 	readyResps := make(chan taggedResponseStream)
 	for idx := range conns {
 		<-connsReady[idx]
+		logEvent("assign", conns[idx].path, eventFields{"start": ranges[idx].start, "end": ranges[idx].end,
+			"rate": rates[idx]})
 		if idx == 0 && firstResponse != nil {
 			// choke the existing request
 			//bytes := ranges[idx].end - ranges[idx].start
@@ -157,10 +223,13 @@ func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct
 			// start a new request
 			req := DoubleRangedGet(url, ranges[idx].start, ranges[idx].end)
 			go func(idx int) {
-				readyResps <- taggedResponseStream{
-					idx: idx,
-					rs:  conns[idx].StartRequest(req),
+				var rs responseStream
+				if pullStreams {
+					rs = conns[idx].StartPullRequest(req, pullMinAhead)
+				} else {
+					rs = conns[idx].StartRequest(req)
 				}
+				readyResps <- taggedResponseStream{idx: idx, rs: rs}
 			}(idx)
 		}
 	}
@@ -170,7 +239,7 @@ func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct
 	}
 	for i := range bw {
 		if bw[i] == nil {
-			bw[i] = NewBwCounter(i)
+			bw[i] = NewBwCounter(conns[i].path)
 		}
 		bw[i].SetOffset(ranges[i].start)
 	}
@@ -186,66 +255,91 @@ func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct
 			trs := <-readyResps
 			rsPerConn[trs.idx] = trs.rs
 			resp := trs.rs.response
-			if resp.StatusCode != 200 && resp.StatusCode != 206 {
+			// a 200 would be the whole resource, not the range
+			if resp.StatusCode != http.StatusPartialContent {
 				log.Panicf("unexpected status code from server: %d", resp.StatusCode)
 			}
 			r := ranges[trs.idx]
 			counter := bw[trs.idx]
 			countedBody := io.TeeReader(resp.Body, counter)
+			finished := make(chan struct{})
+			shown := progress.stream(conns[trs.idx].path, url, r, counter)
+			exported := metrics.stream(conns[trs.idx].path, counter)
+
+			pulled := int64(-1) // credit granted; -1 if not pulled
+			if pullStreams {
+				pulled = pullMinAhead
+			}
 
-			// bandwidth sampling & byte counting goroutine - counter.Rate
+			// bandwidth sampling & byte counting goroutine - counter.Rate; it also pulls
+			// the stream
+			sampled := make(chan struct{})
 			go func() {
-				var lastBytes int64
+				defer close(sampled)
+				var lastReceived int64
 				for {
 					tot := counter.Total()
-					if tot <= lastBytes {
-						// bw counter has just reset; wait for a while
-						lastBytes = 0
-						continue
-					}
-					delta := tot - lastBytes
+					// the rate is what the transport received, which the reading of the
+					// body may lag behind.  An interval without progress is a sample too,
+					// or the next one would count everything received so far
+					received := trs.rs.stream.Stats().Received
+					delta := received - lastReceived
 					counter.AddRate(delta * int64(time.Second/bwSampleInterval)) // in bytes/s
-					lastBytes = tot
+					lastReceived = received
+					logEvent("rate", conns[trs.idx].path, eventFields{
+						"sample": delta * int64(time.Second/bwSampleInterval), "rate": counter.Rate(),
+						"progress": tot})
 
-					// check on the choked connection: if we're at the desired end then close manually
-					// as the remote would be waiting due to unfinished request
-					if firstResponse != nil && trs.idx == 0 {
-						if int(tot) == r.end-r.start {
-							trs.rs.response.Body.Close()
+					if int(tot) == r.end-r.start {
+						return
+					}
+					if pulled >= 0 {
+						// the credit never runs out before the next sample
+						ahead := tot + pullAhead(counter.Rate(), conns[trs.idx].mon.GetRtt())
+						if ahead > pulled {
+							n, err := trs.rs.stream.Pull(ahead - pulled)
+							if err != nil {
+								log.Printf("pull on connection #%d: %v", trs.idx, err)
+							}
+							pulled += n
 						}
 					}
-					if int(tot) == r.end-r.start {
+					select {
+					case <-finished:
+						// choked short of the range end
 						return
+					case <-time.After(bwSampleInterval):
 					}
-					time.Sleep(bwSampleInterval)
 				}
 			}()
 			rsWg.Done()
 
 			//fmt.Println("Reading for", r.start)
-			_, err := io.ReadFull(countedBody, buf[r.start:r.end])
+			n, err := io.ReadFull(countedBody, buf.slice(r))
+			close(finished)
+			<-sampled
+			shown()
+			exported()
+			logEvent("complete", conns[trs.idx].path, eventFields{"start": r.start, "end": r.start + n,
+				"bytes": n})
 			//fmt.Println("Reading for", r.start, "done")
-			if err != nil &&
-				err.Error() == "net/http: server replied with more than declared Content-Length; truncated" {
+			if _, choked := err.(http2.ChokedError); choked {
 				//fmt.Printf("Connection #%d choked and closed\n", trs.idx)
+				// the transport reset the stream when the choke point arrived; this
+				// only frees what arrived past it
+				resp.Body.Close()
 			} else {
 				fatal(fmt.Sprintf("unknown error for read body on connection #%d", trs.idx), err)
+				if firstResponse != nil && trs.idx == 0 {
+					// the full response goes on past the range: close it manually, as the
+					// remote would keep sending the rest of the resource
+					resp.Body.Close()
+				}
 			}
 			transferWg.Done()
 		}()
 	}
 
-	inflightBytes := func(idx int) int64 {
-		rate := bw[idx].Rate()
-		rtt := conns[idx].mon.GetRtt()
-		//fmt.Printf("#%d: rate %d, rtt %v\n", idx, rate, rtt)
-		if rate == 0 || rtt == 0 {
-			return 0
-		} else {
-			return int64(float32(rate) / (float32(time.Second)/float32(rtt)))
-		}
-	}
-
 	// done marks ready of fragRanges - the near-completion (remaining < 1*inflight) of
 	// one connection
 	var fragRanges []contentRange
@@ -255,45 +349,41 @@ func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct
 	rsWg.Wait()
 	// check for first finishing connection and choke others
 	go func(ff *[]contentRange) {
-	outer:
 		for {
+			prog, inflight := make([]int64, nConns), make([]int64, nConns)
 			for idx := range bw {
-				prog := bw[idx].Total()
-				tot := ranges[idx].end - ranges[idx].start
-				inflight := inflightBytes(idx)
-				if int64(tot)-prog < inflight {
-					// the connection is finishing, choke other connections
-					for i := range conns {
-						if i != idx {
-							bwTotal := bw[i].Total()
-							inflight := inflightBytes(i)
-							rangeLen := ranges[i].end - ranges[i].start
-							chokeAt := min(bwTotal+inflight, int64(rangeLen))
-							var newStart, newEnd int
-							// we do not need to do anything if the connection will finish in an RTT
-							if chokeAt != int64(ranges[i].end - ranges[i].start) {
-								if inflight != 0 {
-									//fmt.Printf("Choking %v to %d (bwTotal=%d inflight=%d)\n",
-									//	ranges[i], chokeAt, bwTotal, inflight)
-									// ChokeAt will cut cs.bytesRemain so that the stream ends early
-									rsPerConn[i].stream.ChokeAt(chokeAt)
-								}
-								// do not choke if we failed to figure out inflight bytes
-							}
-							newStart = ranges[i].start + int(chokeAt)
-							newEnd = ranges[i].end
-							if newStart < newEnd {
-								//fmt.Printf("newStart=%d rstart=%d chokeAt=%d newEnd=%d\n", newStart,
-								//	ranges[i].start, int(chokeAt), newEnd)
-								*ff = append(*ff, contentRange{
-									start: newStart,
-									end:   newEnd,
-								})
-							}
-						}
+				prog[idx] = bw[idx].Total()
+				inflight[idx] = inflightBytes(bw[idx].Rate(), marginRtt(conns[idx].mon))
+			}
+			finishing, chokeAt := chokePoints(scheduler, ranges, prog, inflight)
+			if finishing >= 0 {
+				// the connection is finishing, choke other connections
+				logEvent("finishing", conns[finishing].path, eventFields{
+					"remaining": int64(ranges[finishing].end-ranges[finishing].start) - prog[finishing],
+					"inflight":  inflight[finishing]})
+				for i := range conns {
+					rangeLen := int64(ranges[i].end - ranges[i].start)
+					if i == finishing || chokeAt[i] == rangeLen {
+						continue
+					}
+					// the body ends with http2.ChokedError at chokeAt
+					if err := rsPerConn[i].stream.ChokeAt(chokeAt[i]); err != nil {
+						// read past chokeAt already: the rest arrives here, and a fragment
+						// would be read into the same bytes of buf
+						log.Printf("choke connection #%d at %d: %v", i, chokeAt[i], err)
+						continue
+					}
+					logEvent("choke", conns[i].path, eventFields{"start": ranges[i].start,
+						"progress": prog[i], "inflight": inflight[i], "chokeAt": chokeAt[i],
+						"length": rangeLen})
+					if newStart := ranges[i].start + int(chokeAt[i]); newStart < ranges[i].end {
+						*ff = append(*ff, contentRange{
+							start: newStart,
+							end:   ranges[i].end,
+						})
 					}
-					break outer
 				}
+				break
 			}
 			time.Sleep(bwSampleInterval)
 		}
@@ -306,15 +396,99 @@ func nSplitRequest(url string, conns []MonitoredMpConn, connsReady []chan struct
 	newBwCounters := make([]*BwCounter, len(bw))
 	for idx := range bw {
 		//fmt.Printf("Resetting progress counter for connection #%d\n", idx)
-		newBwCounters[idx] = bw[idx].DuplicateBwCounter(idx)
+		newBwCounters[idx] = bw[idx].DuplicateBwCounter(conns[idx].path)
 	}
 
 	//fmt.Printf("fragRanges: %v\n", fragRanges)
+	if len(fragRanges) > 0 {
+		logEvent("refragment", -1, eventFields{"fragments": rangeList(fragRanges)})
+	}
+	var smallFrags []contentRange
+	latest := bw
 	for _, frag := range fragRanges {
+		if multiRange && frag.end-frag.start < minSplitSize {
+			// fetched together below
+			smallFrags = append(smallFrags, frag)
+			continue
+		}
 		//fmt.Printf("Restarting for %d-%d\n", frag.start, frag.end)
-		nSplitRequest(url, conns, connsReady, newBwCounters, frag.start, frag.end, buf, nil)
+		// the fragments share the rate history, but each one counts its own progress
+		for idx := range newBwCounters {
+			newBwCounters[idx].Reset()
+		}
+		latest = nSplitRequest(url, conns, connsReady, newBwCounters, frag.start, frag.end, buf, nil)
+	}
+	if len(smallFrags) > 0 {
+		// one multi-range request per path for all small holes
+		raceRanges(url, conns, connsReady, smallFrags, buf)
 	}
 
 	// do not return until all transfers are ready.
 	transferWg.Wait()
+	return latest
+}
+
+// warmup fetches the first warmupBytes of a download, split equally across the paths as
+// probes whose bytes count toward the output, and returns counters with the rates
+// measured on them to split the rest with
+func warmup(url string, conns []MonitoredMpConn, connsReady []chan struct{}, buf rangeBuf,
+	firstResponse *responseStream) []*BwCounter {
+	bw := newBwCounters(conns, connsReady)
+	logEvent("warmup", -1, eventFields{"bytes": warmupBytes})
+	bw = nSplitRequest(url, conns, connsReady, bw, 0, warmupBytes, buf, firstResponse)
+	for i := range bw {
+		bw[i] = bw[i].DuplicateBwCounter(conns[i].path)
+	}
+	return bw
+}
+
+// warmsUp tells if a download of length bytes without rates starts with warmup: the
+// probes must leave most of it to split
+func warmsUp(length int) bool {
+	return warmupBytes >= minWarmupBytes && length >= 2*warmupBytes
+}
+
+// inflightBytes is what a path with rate bytes per second has on the way during rtt;
+// zero while either is unknown
+func inflightBytes(rate int64, rtt time.Duration) int64 {
+	if rate == 0 || rtt == 0 {
+		return 0
+	}
+	return int64(float32(rate) / (float32(time.Second) / float32(rtt)))
+}
+
+// chokePoints is the decision of the choke monitor of nSplitRequest and of the simulator,
+// given the progress on ranges and the bytes in flight on their paths.  Once a path is
+// about to finish it returns its index, and how much of its range each other path gets:
+// the length of the range for those that finish theirs, or that have no estimate of what
+// is in flight.  The paths choked short of their range leave the rest to split again.
+// finishing is -1 while no path is about to finish.
+func chokePoints(sched Scheduler, ranges []contentRange, progress, inflight []int64) (finishing int,
+	chokeAt []int64) {
+	for idx, r := range ranges {
+		if !sched.Finishing(int64(r.end-r.start)-progress[idx], inflight[idx]) {
+			continue
+		}
+		chokeAt = make([]int64, len(ranges))
+		for i, r := range ranges {
+			rangeLen := int64(r.end - r.start)
+			chokeAt[i] = rangeLen
+			if i != idx && inflight[i] != 0 {
+				chokeAt[i] = sched.ChokeAt(progress[i], inflight[i], rangeLen)
+			}
+		}
+		return idx, chokeAt
+	}
+	return -1, nil
+}
+
+// pullAhead is how far past what it received a pulled stream is granted, given the rate
+// and the RTT of its path: what is in flight twice over, and what comes in until the next
+// grant, so that the path is never held back
+func pullAhead(rate int64, rtt time.Duration) int64 {
+	ahead := rate * int64(2*rtt+2*bwSampleInterval) / int64(time.Second)
+	if ahead < pullMinAhead {
+		return pullMinAhead
+	}
+	return ahead
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testdata is the absolute path of the testdata directory
+var testdata string
+
+func TestMain(m *testing.M) {
+	var err error
+	testdata, err = filepath.Abs("testdata")
+	fatal("testdata", err)
+	// the connections leave keylog.txt in the working directory
+	dir, err := ioutil.TempDir("", "mphttp-test")
+	fatal("temp dir", err)
+	fatal("chdir", os.Chdir(dir))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func startServers(t *testing.T, handler http.Handler, links ...LinkConfig) ([]string, func()) {
+	servers, stop, err := serveLinks(handler, links...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return servers, stop
+}
+
+func randomContent(n int) []byte {
+	content := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(content)
+	return content
+}
+
+func tempOutput(t *testing.T) *os.File {
+	f, err := ioutil.TempFile(".", "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func checkOutput(t *testing.T, f *os.File, content []byte) {
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("output of %d bytes differs from the %d bytes of content", len(got), len(content))
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	// a path without rate still gets a byte, taken from the biggest share
+	ranges := splitRanges(100, 1100, []int64{3, 1, 0, 1})
+	want := []contentRange{{100, 699}, {699, 899}, {899, 900}, {900, 1100}}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Errorf("splitRanges = %v, want %v", ranges, want)
+			break
+		}
+	}
+	// without any rate the range is split evenly
+	ranges = splitRanges(0, 10, []int64{0, 0, 0})
+	if ranges[0].start != 0 || ranges[2].end != 10 {
+		t.Errorf("splitRanges without rates = %v", ranges)
+	}
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].start != ranges[i-1].end || ranges[i].end < ranges[i].start {
+			t.Errorf("splitRanges without rates = %v", ranges)
+		}
+	}
+}
+
+func TestDownloadThroughEmulatedLinks(t *testing.T) {
+	content := randomContent(8 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	// bounded queues, or the whole flow control window would sit on the slow links
+	servers, stop := startServers(t, handler,
+		LinkConfig{Rate: 4 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 2 << 20, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 1 << 20, Delay: 40 * time.Millisecond, Queue: 128 << 10})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+
+	res := download("/content", servers, out)
+	if res.Length != len(content) {
+		t.Errorf("length = %d, want %d", res.Length, len(content))
+	}
+	if res.Sum != sha256.Sum256(content) {
+		t.Error("sha256 mismatch")
+	}
+	for i, stats := range res.Stats {
+		if stats.Body == 0 || stats.Wire < stats.Body {
+			t.Errorf("path %d: %+v", i, stats)
+		}
+	}
+	checkOutput(t, out, content)
+	// 8MiB over 7MiB/s of aggregate capacity; an equal split without refragmentation
+	// would keep the slowest path busy for 2.7s
+	checkDuration(t, "download", res.Duration, 1100*time.Millisecond, 2400*time.Millisecond)
+}
+
+func TestDownloadPulled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pullStreams, qlogDir = true, dir
+	defer func() {
+		pullStreams, qlogDir = false, ""
+	}()
+	content := randomContent(8 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler,
+		LinkConfig{Rate: 4 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 2 << 20, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 1 << 20, Delay: 40 * time.Millisecond, Queue: 128 << 10})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+
+	res := download("/content", servers, out)
+	if res.Length != len(content) {
+		t.Errorf("length = %d, want %d", res.Length, len(content))
+	}
+	checkOutput(t, out, content)
+	// the streams are granted a few RTTs ahead, so pulling must not hold the paths back
+	checkDuration(t, "download", res.Duration, 1100*time.Millisecond, 5*time.Second)
+
+	// the streams start without a window: all their credit is in the traced WINDOW_UPDATE
+	// frames, and the servers send no more than that.  The credit keeps a few RTTs ahead
+	// of what arrived, where the window of an unpulled stream is 4MiB.
+	var pulls int
+	for path := range servers {
+		granted, received, updates := pulledStreams(t, filepath.Join(dir, fmt.Sprintf("path%d.qlog", path)))
+		for id, credit := range granted {
+			if received[id] > credit || credit-received[id] > 2<<20 {
+				t.Errorf("path %d, stream %d: %d bytes received with %d granted", path, id,
+					received[id], credit)
+			}
+			if updates[id] > 1 {
+				pulls++
+			}
+		}
+	}
+	if pulls == 0 {
+		t.Error("no stream was pulled past its first credit")
+	}
+}
+
+// pulledStreams reads the credit granted to the streams of a qlog trace, the DATA they
+// received, and the number of WINDOW_UPDATE frames that granted it
+func pulledStreams(t *testing.T, name string) (granted, received map[uint32]int64, updates map[uint32]int) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	granted, received, updates = map[uint32]int64{}, map[uint32]int64{}, map[uint32]int{}
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // the header
+	for scanner.Scan() {
+		var ev qlogEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+		frame := ev.Data.Frame
+		switch {
+		case frame.StreamID == 0:
+		case ev.Name == "http2:frame_received" && frame.FrameType == "data":
+			received[frame.StreamID] += int64(frame.Length)
+		case ev.Name == "http2:frame_sent" && frame.FrameType == "window_update":
+			granted[frame.StreamID] += int64(frame.Increment)
+			updates[frame.StreamID]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return granted, received, updates
+}
+
+func TestDownloadWarmup(t *testing.T) {
+	warmupBytes = 256 << 10
+	defer func() {
+		warmupBytes = 0
+	}()
+	content := randomContent(8 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler,
+		LinkConfig{Rate: 4 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 1 << 20, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 256 << 10, Delay: 40 * time.Millisecond, Queue: 128 << 10})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+
+	res := download("/content", servers, out)
+	if res.Length != len(content) {
+		t.Errorf("length = %d, want %d", res.Length, len(content))
+	}
+	checkOutput(t, out, content)
+	// the slowest path would take 10s for an equal share of the rest
+	checkDuration(t, "download", res.Duration, 1300*time.Millisecond, 5*time.Second)
+}
+
+func TestDownloadSmallWarmup(t *testing.T) {
+	warmupBytes = minWarmupBytes
+	var err error
+	if events, err = createEventLog("events.jsonl"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		warmupBytes, events = 0, nil
+	}()
+	content := randomContent(1 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler, LinkConfig{}, LinkConfig{}, LinkConfig{})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+
+	download("/content", servers, out)
+	checkOutput(t, out, content)
+	if err := events.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("events.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the probes are split, each path getting its own, rather than raced for
+	if !bytes.Contains(data, []byte(`"event":"warmup"`)) ||
+		!bytes.Contains(data, []byte(fmt.Sprintf(`"end":%d,"ranges":[[0,%d]`, minWarmupBytes, minSplitSize))) {
+		t.Errorf("no split of the warm-up in %s", data)
+	}
+}
+
+func TestDownloadThroughTraces(t *testing.T) {
+	var links []LinkConfig
+	// synthetic one-second traces averaging 1.5MB/s, 2.4MB/s and 2.1MB/s
+	for _, name := range []string{"steady", "bursty", "outage"} {
+		trace, err := loadTrace(filepath.Join(testdata, name+".trace"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, LinkConfig{Trace: trace, Delay: 20 * time.Millisecond, Queue: 128 << 10})
+	}
+	content := randomContent(6 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler, links...)
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+
+	res := download("/content", servers, out)
+	if res.Length != len(content) {
+		t.Errorf("length = %d, want %d", res.Length, len(content))
+	}
+	checkOutput(t, out, content)
+	// how well the engine follows the bursts and the outage varies from run to run; this
+	// only catches stalls
+	checkDuration(t, "download", res.Duration, 900*time.Millisecond, 8*time.Second)
+}
+
+func TestDownloadWithoutRanges(t *testing.T) {
+	content := randomContent(1 << 20)
+	// ignores Range, answering the whole resource with its length
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	})
+	servers, stop := startServers(t, handler, LinkConfig{}, LinkConfig{}, LinkConfig{})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+
+	res := download("/content", servers, out)
+	if res.Length != len(content) {
+		t.Errorf("length = %d, want %d", res.Length, len(content))
+	}
+	checkOutput(t, out, content)
+}
+
+func TestDownloadStreamUnknownLength(t *testing.T) {
+	content := randomContent(3 << 20)
+	// answers ranges with an unknown complete length, as for a resource being generated
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			end = len(content) - 1
+		}
+		if start >= len(content) {
+			w.Header().Set("Content-Range", "bytes */*")
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if end >= len(content) {
+			end = len(content) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, end))
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : end+1])
+	})
+	servers, stop := startServers(t, handler,
+		LinkConfig{Rate: 2 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 2 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 2 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+
+	res := download("/content", servers, out)
+	if res.Length != len(content) {
+		t.Errorf("length = %d, want %d", res.Length, len(content))
+	}
+	checkOutput(t, out, content)
+	// a single path would need 1.5s
+	checkDuration(t, "download", res.Duration, 500*time.Millisecond, 1400*time.Millisecond)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// multiRange enables fetching the small fragments left after refragmentation with a
+// single multi-range request per path, instead of one request per fragment and path
+var multiRange bool
+
+// placeRange copies data, which starts at offset off of the resource, into the parts of
+// dst (destinations of the requested ranges) it overlaps, adding the intervals it filled,
+// relative to the start of the range, to filled.  Parts may overlap or repeat, so it is
+// the union of these intervals that tells if a range is complete.
+func placeRange(ranges []contentRange, dst [][]byte, filled [][]contentRange, off int, data []byte) {
+	for i, r := range ranges {
+		lo, hi := r.start, r.end
+		if off > lo {
+			lo = off
+		}
+		if off+len(data) < hi {
+			hi = off + len(data)
+		}
+		if lo < hi {
+			copy(dst[i][lo-r.start:hi-r.start], data[lo-off:hi-off])
+			filled[i] = append(filled[i], contentRange{lo - r.start, hi - r.start})
+		}
+	}
+}
+
+// fetchRanges fetches several disjoint ranges over conn with a single request, copying
+// ranges[i] into dst[i].  The multipart/byteranges response is taken apart by the
+// Content-Range of its parts.  A server may also coalesce the ranges into one (206 with
+// a single Content-Range), from which only the requested bytes are kept.  Ranges the
+// response did not cover, e.g. because the server rejected multiple ranges, are fetched
+// with a request each.
+func fetchRanges(ctx context.Context, conn MonitoredMpConn, url string, ranges []contentRange,
+	dst [][]byte) error {
+	filled := make([][]contentRange, len(ranges))
+	rs := conn.StartRequest(MultiRangedGet(url, ranges).WithContext(ctx))
+	if rs.response != nil {
+		resp := rs.response
+		if resp.StatusCode == http.StatusPartialContent {
+			mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if strings.HasPrefix(mediaType, "multipart/") {
+				mr := multipart.NewReader(resp.Body, params["boundary"])
+				for {
+					part, err := mr.NextPart()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						resp.Body.Close()
+						return err
+					}
+					start, _, _, err := parseContentRange(part.Header.Get("Content-Range"))
+					if err != nil {
+						resp.Body.Close()
+						return err
+					}
+					data, err := ioutil.ReadAll(part)
+					if err != nil {
+						resp.Body.Close()
+						return err
+					}
+					placeRange(ranges, dst, filled, start, data)
+				}
+			} else if start, _, _, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil {
+				data, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					resp.Body.Close()
+					return err
+				}
+				placeRange(ranges, dst, filled, start, data)
+			}
+		}
+		// a 200 would be the whole resource: better fetch the ranges one by one
+		resp.Body.Close()
+	}
+
+	var errs []string
+	var mux sync.Mutex
+	wg := sync.WaitGroup{}
+	for i, r := range ranges {
+		if coveredBytes(filled[i], r.end-r.start) == int64(r.end-r.start) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, r contentRange) {
+			defer wg.Done()
+			rs := conn.StartRequest(DoubleRangedGet(url, r.start, r.end).WithContext(ctx))
+			var err error
+			if rs.response == nil {
+				err = fmt.Errorf("request for %d-%d failed", r.start, r.end)
+			} else {
+				_, err = readRange(rs.response, r, dst[i])
+				rs.response.Body.Close()
+			}
+			if err != nil {
+				mux.Lock()
+				errs = append(errs, err.Error())
+				mux.Unlock()
+			}
+		}(i, r)
+	}
+	wg.Wait()
+	if errs != nil {
+		return fmt.Errorf("fetch ranges: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// readRange reads the response to a request for r into dst, which it must be a 206 for:
+// a 200 would be the resource from its start.  Returns the bytes read.
+func readRange(resp *http.Response, r contentRange, dst []byte) (int, error) {
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected status code for %d-%d: %d", r.start, r.end, resp.StatusCode)
+	}
+	cr := resp.Header.Get("Content-Range")
+	if start, _, _, err := parseContentRange(cr); err != nil || start != r.start {
+		return 0, fmt.Errorf("unexpected Content-Range for %d-%d: %q", r.start, r.end, cr)
+	}
+	return io.ReadFull(resp.Body, dst)
+}
+
+// raceRanges fetches the ranges with one multi-range request on every connection, and
+// keeps the response of the first connection to finish.  The others are cancelled.  It
+// is fatal for all of them to fail.
+func raceRanges(url string, conns []MonitoredMpConn, connsReady []chan struct{},
+	ranges []contentRange, buf rangeBuf) {
+	type taggedBufs struct {
+		idx  int
+		bufs [][]byte
+	}
+	logEvent("race", -1, eventFields{"ranges": rangeList(ranges)})
+	// buffered, so that the slower connections do not block after the winner is taken
+	bufChan := make(chan taggedBufs, len(conns))
+	errChan := make(chan error, len(conns))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for idx := range conns {
+		go func(idx int) {
+			<-connsReady[idx]
+			bufs := make([][]byte, len(ranges))
+			for i, r := range ranges {
+				bufs[i] = make([]byte, r.end-r.start)
+			}
+			if err := fetchRanges(ctx, conns[idx], url, ranges, bufs); err != nil {
+				errChan <- fmt.Errorf("connection #%d: %v", idx, err)
+				return
+			}
+			bufChan <- taggedBufs{idx: idx, bufs: bufs}
+		}(idx)
+	}
+	var firstFinish taggedBufs
+	var errs []string
+	for firstFinish.bufs == nil {
+		select {
+		case firstFinish = <-bufChan:
+		case err := <-errChan:
+			if errs = append(errs, err.Error()); len(errs) == len(conns) {
+				log.Fatalf("multi-range request failed on every connection: %s", strings.Join(errs, "; "))
+			}
+		}
+	}
+	logEvent("complete", conns[firstFinish.idx].path, eventFields{"ranges": rangeList(ranges)})
+	for i, r := range ranges {
+		copy(buf.slice(r), firstFinish.bufs[i])
+	}
+	progress.done(url, ranges...)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchRangesOneByOne(t *testing.T) {
+	content := randomContent(64 << 10)
+	var ignoreRanges int32 // set atomically
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ignoreRanges) == 1 || strings.Contains(r.Header.Get("Range"), ",") {
+			// multiple ranges are answered with the whole resource
+			w.Write(content)
+			return
+		}
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler, LinkConfig{})
+	defer stop()
+	conn := NewMonitoredMpConn(servers[0], 0)
+	defer conn.Close()
+
+	ranges := []contentRange{{100, 200}, {1000, 5000}, {60000, 65536}}
+	dst := make([][]byte, len(ranges))
+	for i, r := range ranges {
+		dst[i] = make([]byte, r.end-r.start)
+	}
+	if err := fetchRanges(context.Background(), conn, "/content", ranges, dst); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range ranges {
+		if !bytes.Equal(dst[i], content[r.start:r.end]) {
+			t.Errorf("range %v differs", r)
+		}
+	}
+
+	// single ranges answered whole would fill every range with the start
+	atomic.StoreInt32(&ignoreRanges, 1)
+	if err := fetchRanges(context.Background(), conn, "/content", ranges, dst); err == nil {
+		t.Error("ranges answered with the whole resource were taken")
+	}
+}
+
+func TestFetchRangesOneRequest(t *testing.T) {
+	content := randomContent(64 << 10)
+	ranges := []contentRange{{100, 200}, {1000, 5000}, {60000, 65536}}
+	// multipart writes the parts of a multipart/byteranges response
+	multipartResponse := func(w http.ResponseWriter, parts []contentRange) {
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusPartialContent)
+		for _, p := range parts {
+			pw, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", p.start, p.end-1, len(content))},
+			})
+			pw.Write(content[p.start:p.end])
+		}
+		mw.Close()
+	}
+	for _, test := range []struct {
+		name     string
+		serve    func(w http.ResponseWriter, r *http.Request)
+		requests int32
+	}{
+		{"multipart", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+		}, 1},
+		{"coalesced", func(w http.ResponseWriter, r *http.Request) {
+			// one range from the first byte requested to the last
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 100-65535/%d", len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[100:])
+		}, 1},
+		{"repeated part", func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Range"), ",") {
+				http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+				return
+			}
+			// half of the first range twice: as many bytes as the range, not all of them
+			multipartResponse(w, []contentRange{{100, 150}, {100, 150}, ranges[1], ranges[2]})
+		}, 2},
+	} {
+		var requests int32 // counted atomically
+		servers, stop := startServers(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			test.serve(w, r)
+		}), LinkConfig{})
+		conn := NewMonitoredMpConn(servers[0], 0)
+		dst := make([][]byte, len(ranges))
+		for i, r := range ranges {
+			dst[i] = make([]byte, r.end-r.start)
+		}
+		if err := fetchRanges(context.Background(), conn, "/content", ranges, dst); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		for i, r := range ranges {
+			if !bytes.Equal(dst[i], content[r.start:r.end]) {
+				t.Errorf("%s: range %v differs", test.name, r)
+			}
+		}
+		if n := atomic.LoadInt32(&requests); n != test.requests {
+			t.Errorf("%s: %d requests, want %d", test.name, n, test.requests)
+		}
+		conn.Close()
+		stop()
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// pathCacheHalfLife is how fast what a past run learned of a path fades: a profile
+	// weighs as much as a new measurement when fresh, half as much after that long
+	pathCacheHalfLife = 24 * time.Hour
+	// pathCacheMaxAge is how long a profile is trusted at all
+	pathCacheMaxAge = 30 * 24 * time.Hour
+)
+
+// pathProfile is what past runs learned of a path
+type pathProfile struct {
+	Rate    int64     `json:"rate"`   // bytes per second
+	Rtt     float64   `json:"rtt"`    // smoothed, in ms
+	RttVar  float64   `json:"rttvar"` // in ms
+	Updated time.Time `json:"updated"`
+}
+
+// pathCache holds the profiles of the paths by pathKey
+type pathCache map[string]pathProfile
+
+// pathCacheFile is where the profiles are kept across runs; empty with --nopathcache.
+// pathProfiles are the ones loaded from it when the run started.
+var (
+	pathCacheFile string
+	pathProfiles  pathCache
+)
+
+// defaultPathCacheFile is paths.json in the mphttp directory of the user cache, empty if
+// the user has none
+func defaultPathCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mphttp", "paths.json")
+}
+
+// pathKey identifies a path to server through the interface of local: the same mirror
+// is another path on another network
+func pathKey(server string, local net.Addr) string {
+	if addr, ok := local.(*net.TCPAddr); ok {
+		return server + " from " + addr.IP.String()
+	}
+	return server
+}
+
+// loadPathCache reads the profiles of file; none if it does not exist or is broken
+func loadPathCache(file string) pathCache {
+	cache := pathCache{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print("path cache: ", err)
+		}
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("path cache %s: %v", file, err)
+		return pathCache{}
+	}
+	return cache
+}
+
+// save writes the profiles to file, replacing it at once so that concurrent runs do not
+// read half of it
+func (c pathCache) save(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// lookup returns the profile of the path key, if one is known and not too old at now
+func (c pathCache) lookup(key string, now time.Time) (pathProfile, bool) {
+	p, ok := c[key]
+	if !ok || now.Sub(p.Updated) > pathCacheMaxAge {
+		return pathProfile{}, false
+	}
+	return p, true
+}
+
+// update blends a new measurement of the path key into its profile, the old one
+// weighing less the older it is
+func (c pathCache) update(key string, p pathProfile) {
+	old, ok := c.lookup(key, p.Updated)
+	if ok {
+		w := 0.5 * math.Exp2(-float64(p.Updated.Sub(old.Updated))/float64(pathCacheHalfLife))
+		p.Rate = int64(w*float64(old.Rate) + (1-w)*float64(p.Rate))
+		p.Rtt = w*old.Rtt + (1-w)*p.Rtt
+		p.RttVar = w*old.RttVar + (1-w)*p.RttVar
+	}
+	c[key] = p
+}
+
+// cachedCounters returns counters seeded with the rates of the profiles of the paths, or
+// nil unless all of them are known
+func cachedCounters(conns []MonitoredMpConn, connsReady []chan struct{}) []*BwCounter {
+	if pathCacheFile == "" {
+		return nil
+	}
+	bw := newBwCounters(conns, connsReady)
+	for i := range conns {
+		p, ok := pathProfiles.lookup(conns[i].key, time.Now())
+		if !ok {
+			return nil
+		}
+		bw[i].AddRate(p.Rate)
+	}
+	for i := range conns {
+		logEvent("pathcache", conns[i].path, eventFields{"rate": bw[i].Rate()})
+	}
+	return bw
+}
+
+// rememberPaths records the sustained rates of bw and the RTTs of the paths of conns to the path
+// cache, for the next runs
+func rememberPaths(conns []MonitoredMpConn, bw []*BwCounter) {
+	if pathCacheFile == "" || bw == nil {
+		return
+	}
+	// what other runs recorded in the meantime is kept
+	cache := loadPathCache(pathCacheFile)
+	now := time.Now()
+	for i := range conns {
+		rate, rtt := bw[i].SustainedRate(), conns[i].mon.GetRtt()
+		if rate == 0 || rtt == 0 {
+			continue
+		}
+		cache.update(conns[i].key, pathProfile{Rate: rate, Rtt: msec(rtt),
+			RttVar: msec(conns[i].mon.GetRttVar()), Updated: now})
+	}
+	if err := cache.save(pathCacheFile); err != nil {
+		log.Print("path cache: ", err)
+	}
+}
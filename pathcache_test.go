@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPathKey(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 51234}
+	if key := pathKey("mirror:443", local); key != "mirror:443 from 192.168.1.10" {
+		t.Errorf("key = %q", key)
+	}
+	// the port of the local end changes with every connection
+	local.Port++
+	if key := pathKey("mirror:443", local); key != "mirror:443 from 192.168.1.10" {
+		t.Errorf("key with another port = %q", key)
+	}
+}
+
+func TestPathCacheUpdate(t *testing.T) {
+	now := time.Now()
+	cache := pathCache{}
+	cache.update("a", pathProfile{Rate: 1000, Rtt: 20, RttVar: 4, Updated: now})
+	if p := cache["a"]; p.Rate != 1000 || p.Rtt != 20 || p.RttVar != 4 {
+		t.Errorf("first profile = %+v", p)
+	}
+	// a fresh profile weighs as much as the new measurement
+	cache.update("a", pathProfile{Rate: 3000, Rtt: 40, RttVar: 8, Updated: now})
+	if p := cache["a"]; p.Rate != 2000 || p.Rtt != 30 || p.RttVar != 6 {
+		t.Errorf("after a fresh measurement: %+v", p)
+	}
+	// one a half-life old, half as much
+	cache.update("a", pathProfile{Rate: 5000, Rtt: 30, Updated: now.Add(pathCacheHalfLife)})
+	if p := cache["a"]; p.Rate != 4250 || p.Rtt != 30 {
+		t.Errorf("after a half-life: %+v", p)
+	}
+	// one too old, not at all
+	later := now.Add(pathCacheHalfLife + pathCacheMaxAge + time.Second)
+	if _, ok := cache.lookup("a", later); ok {
+		t.Error("stale profile looked up")
+	}
+	cache.update("a", pathProfile{Rate: 100, Rtt: 10, Updated: later})
+	if p := cache["a"]; p.Rate != 100 || p.Rtt != 10 {
+		t.Errorf("after a stale profile: %+v", p)
+	}
+}
+
+func TestPathCacheSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pathcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mphttp", "paths.json")
+	if cache := loadPathCache(file); len(cache) != 0 {
+		t.Errorf("cache without a file = %v", cache)
+	}
+	updated := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	cache := pathCache{"a": {Rate: 1000, Rtt: 20.5, RttVar: 3, Updated: updated}}
+	if err := cache.save(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loadPathCache(file)
+	if p := loaded["a"]; len(loaded) != 1 || p.Rate != 1000 || p.Rtt != 20.5 || p.RttVar != 3 ||
+		!p.Updated.Equal(updated) {
+		t.Errorf("loaded %v", loaded)
+	}
+	if err := ioutil.WriteFile(file, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cache := loadPathCache(file); len(cache) != 0 {
+		t.Errorf("cache of a broken file = %v", cache)
+	}
+}
+
+func TestDownloadPathCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pathcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pathCacheFile = filepath.Join(dir, "paths.json")
+	defer func() {
+		pathCacheFile, pathProfiles = "", nil
+	}()
+	content := randomContent(4 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler,
+		LinkConfig{Rate: 4 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 1 << 20, Delay: 20 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 256 << 10, Delay: 40 * time.Millisecond, Queue: 128 << 10})
+	defer stop()
+
+	// the first run only warms up, without profiles
+	warmupBytes = 256 << 10
+	defer func() {
+		warmupBytes, events = 0, nil
+	}()
+	var splits [][]contentRange
+	for run := 0; run < 2; run++ {
+		pathProfiles = loadPathCache(pathCacheFile)
+		if run == 1 {
+			// the RTT estimates start from the profiles
+			for _, server := range servers {
+				key := server + " from 127.0.0.1"
+				p := pathProfiles[key]
+				if rtt := NewRttMonitor(nil, 0, key).GetRtt(); p.Rtt == 0 ||
+					rtt != time.Duration(p.Rtt*float64(time.Millisecond)) {
+					t.Errorf("RTT of %s = %v, profile %+v", server, rtt, p)
+				}
+			}
+		}
+		if events, err = createEventLog("events.jsonl"); err != nil {
+			t.Fatal(err)
+		}
+		out := tempOutput(t)
+		download("/content", servers, out)
+		checkOutput(t, out, content)
+		out.Close()
+		if err := events.Close(); err != nil {
+			t.Fatal(err)
+		}
+		warmedUp, ranges := firstSplit(t, "events.jsonl")
+		if warmedUp != (run == 0) {
+			t.Errorf("run %d warmed up: %v", run, warmedUp)
+		}
+		splits = append(splits, ranges)
+	}
+	// the paths are 4MiB/s, 1MiB/s and 256KiB/s: the first split of the second run
+	// follows their rates
+	if r := splits[1]; len(r) != len(servers) ||
+		r[0].end-r[0].start <= 2*(r[1].end-r[1].start) || r[1].end-r[1].start <= 2*(r[2].end-r[2].start) {
+		t.Errorf("first split of the second run = %v", r)
+	}
+	cache := loadPathCache(pathCacheFile)
+	if len(cache) != len(servers) {
+		t.Fatalf("cache = %v", cache)
+	}
+	var rates []int64
+	for _, server := range servers {
+		p := cache[server+" from 127.0.0.1"]
+		if p.Rate == 0 || p.Rtt == 0 {
+			t.Errorf("profile of %s = %+v", server, p)
+		}
+		rates = append(rates, p.Rate)
+	}
+	if rates[0] <= rates[1] || rates[1] <= rates[2] {
+		t.Errorf("rates of the paths = %v", rates)
+	}
+}
+
+// firstSplit reads the event log file, telling if the download warmed up and what its
+// first split was
+func firstSplit(t *testing.T, file string) (warmedUp bool, ranges []contentRange) {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev struct {
+			Event  string
+			Ranges [][2]int
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+		switch {
+		case ev.Event == "warmup":
+			warmedUp = true
+		case ev.Event == "split" && ranges == nil:
+			for _, r := range ev.Ranges {
+				ranges = append(ranges, contentRange{r[0], r[1]})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return warmedUp, ranges
+}
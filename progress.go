@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressInterval is how often the display is redrawn on a terminal
+	progressInterval = 250 * time.Millisecond
+	// progressLogInterval is how often a progress line is logged otherwise
+	progressLogInterval = 2 * time.Second
+)
+
+// progressDisplay shows how a download is doing while it runs: the overall progress, and
+// per path the rate, RTT, ranges in flight and bytes read.  On a terminal it is redrawn
+// in place below the other output; otherwise a line is logged now and then.  The methods
+// do nothing on a nil display.
+type progressDisplay struct {
+	w           io.Writer
+	interactive bool
+	length      int64
+	conns       []*MonitoredMpConn // by path; nil until connected
+	streams     map[*progressStream]bool
+	covered     map[string][]contentRange // by URL: the ranges read by finished streams
+	drawn       int                       // lines of the last drawing, overwritten by the next one
+	stop        chan struct{}
+	stopped     chan struct{}
+	mux         sync.Mutex // protects all above
+}
+
+// progressStream is a response body being read
+type progressStream struct {
+	path    int
+	url     string
+	r       contentRange
+	counter *BwCounter
+}
+
+// read is the part of the range read so far
+func (st *progressStream) read() contentRange {
+	return contentRange{st.r.start, st.r.start + int(st.counter.Total())}
+}
+
+// progress is the display of the running download; nil if disabled
+var progress *progressDisplay
+
+// newProgressDisplay starts a display on f, redrawn in place if f is a terminal
+func newProgressDisplay(f *os.File) *progressDisplay {
+	d := &progressDisplay{
+		w:       f,
+		streams: map[*progressStream]bool{},
+		covered: map[string][]contentRange{},
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		d.interactive = true
+	}
+	interval := progressLogInterval
+	if d.interactive {
+		interval = progressInterval
+	}
+	go func() {
+		defer close(d.stopped)
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-time.After(interval):
+			}
+			d.mux.Lock()
+			d.draw()
+			d.mux.Unlock()
+		}
+	}()
+	return d
+}
+
+// Stop draws the display a last time and stops updating it
+func (d *progressDisplay) Stop() {
+	if d == nil {
+		return
+	}
+	close(d.stop)
+	<-d.stopped
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.interactive {
+		d.draw()
+		// keep the last drawing
+		d.drawn = 0
+	}
+}
+
+// addPath shows conn, which must be connected
+func (d *progressDisplay) addPath(conn MonitoredMpConn) {
+	if d == nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for len(d.conns) <= conn.path {
+		d.conns = append(d.conns, nil)
+	}
+	d.conns[conn.path] = &conn
+}
+
+// expect adds length bytes to what is to be downloaded
+func (d *progressDisplay) expect(length int) {
+	if d == nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.length += int64(length)
+}
+
+// stream shows the range r of url in flight on path, its progress counted by counter,
+// until the returned function is called
+func (d *progressDisplay) stream(path int, url string, r contentRange, counter *BwCounter) func() {
+	if d == nil {
+		return func() {}
+	}
+	st := &progressStream{path: path, url: url, r: r, counter: counter}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.streams[st] = true
+	return func() {
+		d.mux.Lock()
+		defer d.mux.Unlock()
+		delete(d.streams, st)
+		d.covered[url] = append(d.covered[url], st.read())
+	}
+}
+
+// done counts the ranges of url as read, for those not read through a stream
+func (d *progressDisplay) done(url string, ranges ...contentRange) {
+	if d == nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.covered[url] = append(d.covered[url], ranges...)
+}
+
+// logf prints a line of output, above the progress display if there is one
+func logf(format string, a ...interface{}) {
+	if progress == nil || !progress.interactive {
+		fmt.Printf(format, a...)
+		return
+	}
+	d := progress
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.erase()
+	fmt.Fprintf(d.w, format, a...)
+	d.draw()
+}
+
+func (d *progressDisplay) erase() {
+	if d.drawn > 0 {
+		// up to the first line of the drawing, and clear from there
+		fmt.Fprintf(d.w, "\x1b[%dA\x1b[J", d.drawn)
+		d.drawn = 0
+	}
+}
+
+func (d *progressDisplay) draw() {
+	lines := d.lines()
+	if !d.interactive {
+		fmt.Fprintln(d.w, "progress: "+strings.Join(lines, " | "))
+		return
+	}
+	d.erase()
+	for _, line := range lines {
+		fmt.Fprintln(d.w, line)
+	}
+	d.drawn = len(lines)
+}
+
+// lines renders the overall progress, then a line per path
+func (d *progressDisplay) lines() []string {
+	var streams []*progressStream
+	for st := range d.streams {
+		streams = append(streams, st)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].r.start < streams[j].r.start })
+
+	var lines []string
+	var total int64
+	var rate int64
+	for path, conn := range d.conns {
+		if conn == nil {
+			lines = append(lines, fmt.Sprintf("path %d: connecting", path))
+			continue
+		}
+		body := conn.Stats().Body
+		total += body
+		var pathRate int64
+		var ranges []string
+		for _, st := range streams {
+			if st.path != path {
+				continue
+			}
+			pathRate += st.counter.Rate()
+			ranges = append(ranges, fmt.Sprintf("%d-%d %.0f%%", st.r.start, st.r.end,
+				float64(st.counter.Total())*100/float64(st.r.end-st.r.start)))
+		}
+		rate += pathRate
+		if ranges == nil {
+			ranges = []string{"idle"}
+		}
+		lines = append(lines, fmt.Sprintf("path %d: %s, rtt %v, %s read, %s", path,
+			formatRate(float64(pathRate)), conn.MeasureRtt().Round(100*time.Microsecond), formatSize(body),
+			strings.Join(ranges, ", ")))
+	}
+
+	overall := fmt.Sprintf("%s, %s", formatSize(total), formatRate(float64(rate)))
+	if d.length > 0 {
+		// duplicates do not count: only what the union of the ranges read covers
+		var done int64
+		for url, covered := range d.covered {
+			// coveredBytes sorts what it is given
+			ranges := append([]contentRange(nil), covered...)
+			for _, st := range streams {
+				if st.url == url {
+					ranges = append(ranges, st.read())
+				}
+			}
+			done += coveredBytes(ranges, int(d.length))
+		}
+		done = min(done, d.length)
+		eta := "-"
+		if rate > 0 {
+			left := time.Duration(float64(d.length-done) / float64(rate) * float64(time.Second))
+			eta = left.Round(time.Second).String()
+		}
+		overall = fmt.Sprintf("%5.1f%% of %s, %s, ETA %s", float64(done)*100/float64(d.length),
+			formatSize(d.length), formatRate(float64(rate)), eta)
+	}
+	return append([]string{overall}, lines...)
+}
+
+// formatSize formats a number of bytes
+func formatSize(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.2f GB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1f MB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1f kB", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%d B", n)
+}
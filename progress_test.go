@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeConn is a connected path with fixed stats and RTT
+type fakeConn struct {
+	stats connStats
+	rtt   time.Duration
+}
+
+func (c fakeConn) MeasureRtt() time.Duration                   { return c.rtt }
+func (c fakeConn) Close()                                      {}
+func (c fakeConn) StartRequest(r *http.Request) responseStream { return responseStream{} }
+func (c fakeConn) Stats() connStats                            { return c.stats }
+func (c fakeConn) Start()                                      {}
+func (c fakeConn) Stop()                                       {}
+func (c fakeConn) GetRtt() time.Duration                       { return c.rtt }
+func (c fakeConn) GetRttVar() time.Duration                    { return 0 }
+func (c fakeConn) GetMinRtt() time.Duration                    { return c.rtt }
+
+func (c fakeConn) StartPullRequest(r *http.Request, credit int64) responseStream {
+	return responseStream{}
+}
+
+func (c fakeConn) TCPInfo() (tcpInfo, error) { return tcpInfo{Rtt: c.rtt}, nil }
+func (c fakeConn) LocalAddr() net.Addr       { return nil }
+
+func TestProgressDisplay(t *testing.T) {
+	var buf bytes.Buffer
+	d := &progressDisplay{w: &buf, interactive: true, streams: map[*progressStream]bool{},
+		covered: map[string][]contentRange{}}
+	conn := fakeConn{stats: connStats{Body: 700}, rtt: 20 * time.Millisecond}
+	d.addPath(MonitoredMpConn{conn: conn, mon: conn, path: 1})
+	d.expect(1000)
+
+	counter := NewBwCounter(1)
+	counter.SetOffset(0)
+	counter.Write(make([]byte, 300))
+	counter.AddRate(100)
+	finish := d.stream(1, "/a", contentRange{0, 500}, counter)
+	// a duplicate of bytes already read by the stream
+	d.done("/a", contentRange{100, 200}, contentRange{500, 600})
+
+	lines := d.lines()
+	want := []string{
+		" 40.0% of 1.0 kB, 100 B/s, ETA 6s",
+		"path 0: connecting",
+		"path 1: 100 B/s, rtt 20ms, 700 B read, 0-500 60%",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	finish()
+	if lines := d.lines(); lines[0] != " 40.0% of 1.0 kB, 0 B/s, ETA -" || !strings.HasSuffix(lines[2], "idle") {
+		t.Errorf("lines after the stream = %q", lines)
+	}
+
+	// output goes above the display, which is redrawn below it
+	progress = d
+	defer func() {
+		progress = nil
+	}()
+	d.draw()
+	buf.Reset()
+	logf("hello %d\n", 1)
+	if out := buf.String(); !strings.HasPrefix(out, "\x1b[3A\x1b[Jhello 1\n 40.0%") || d.drawn != 3 {
+		t.Errorf("logf wrote %q", out)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"mphttp/dep/http2"
+)
+
+// qlogDir is where --qlog writes a frame trace per path; empty if disabled
+var qlogDir string
+
+// frameTrace writes the HTTP/2 frames of a path in the spirit of qlog, as JSON lines:
+// a header naming the path, then an event per frame, e.g.
+//
+//	{"time":12.345,"name":"http2:frame_received","data":{"frame":{"frame_type":"data",...},"flow":{...}}}
+//
+// time is in milliseconds since globalStart, like the times of the event log.  flow is
+// the receive window of the client after the frame, of the connection and of the stream
+// with the window granted to the server since the stream started, the choke point and
+// the bytes of the body read, for choke analysis.
+type frameTrace struct {
+	f   *os.File
+	w   *bufio.Writer
+	mux sync.Mutex // protects w
+}
+
+type qlogFrame struct {
+	FrameType    string `json:"frame_type"`
+	StreamID     uint32 `json:"stream_id"`
+	Length       uint32 `json:"length"`
+	EndStream    bool   `json:"end_stream,omitempty"`
+	Ack          bool   `json:"ack,omitempty"`
+	Increment    uint32 `json:"increment,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	LastStreamID uint32 `json:"last_stream_id,omitempty"`
+}
+
+type qlogFlow struct {
+	ConnInflow   int32 `json:"conn_inflow"`
+	StreamInflow int32 `json:"stream_inflow,omitempty"`
+	TokensSent   int64 `json:"tokens_sent,omitempty"`
+	ChokeAt      int64 `json:"choke_at,omitempty"`
+	Delivered    int64 `json:"delivered,omitempty"`
+}
+
+type qlogEvent struct {
+	Time float64 `json:"time"`
+	Name string  `json:"name"`
+	Data struct {
+		Frame qlogFrame `json:"frame"`
+		Flow  qlogFlow  `json:"flow"`
+	} `json:"data"`
+}
+
+// createFrameTrace starts the trace of path, connected to server, in qlogDir; nil if
+// --qlog is disabled
+func createFrameTrace(path int, server string) (*frameTrace, error) {
+	if qlogDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(qlogDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(qlogDir, fmt.Sprintf("path%d.qlog", path)))
+	if err != nil {
+		return nil, err
+	}
+	t := &frameTrace{f: f, w: bufio.NewWriter(f)}
+	header := map[string]interface{}{
+		"qlog_version": "0.3",
+		"qlog_format":  "NDJSON",
+		"title":        fmt.Sprintf("mphttp path %d", path),
+		"trace": map[string]interface{}{
+			"vantage_point": map[string]string{"type": "client"},
+			"common_fields": map[string]interface{}{
+				"path":           path,
+				"server":         server,
+				"protocol_type":  "HTTP2",
+				"time_format":    "relative",
+				"reference_time": float64(globalStart.UnixNano()) / 1e6,
+			},
+		},
+	}
+	t.writeJSON(header)
+	return t, nil
+}
+
+// frame records ev; it is the FrameTrace of the http2.Transport of the path
+func (t *frameTrace) frame(ev http2.FrameEvent) {
+	var e qlogEvent
+	e.Time = msec(ev.Time.Sub(globalStart))
+	e.Name = "http2:frame_received"
+	if ev.Sent {
+		e.Name = "http2:frame_sent"
+	}
+	e.Data.Frame = qlogFrame{
+		FrameType:    strings.ToLower(ev.Type.String()),
+		StreamID:     ev.StreamID,
+		Length:       ev.Length,
+		Increment:    ev.Increment,
+		LastStreamID: ev.LastStreamID,
+	}
+	switch ev.Type {
+	case http2.FrameData:
+		e.Data.Frame.EndStream = ev.Flags.Has(http2.FlagDataEndStream)
+	case http2.FramePing:
+		e.Data.Frame.Ack = ev.Flags.Has(http2.FlagPingAck)
+	case http2.FrameRSTStream, http2.FrameGoAway:
+		e.Data.Frame.ErrorCode = ev.ErrCode.String()
+	}
+	e.Data.Flow = qlogFlow{
+		ConnInflow:   ev.ConnInflow,
+		StreamInflow: ev.StreamInflow,
+		TokensSent:   ev.TokensSent,
+		ChokeAt:      ev.ChokeAt,
+		Delivered:    ev.Delivered,
+	}
+	t.writeJSON(e)
+}
+
+func (t *frameTrace) writeJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	fatal("encode frame trace", err)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.w.Write(append(b, '\n'))
+}
+
+// Close flushes the trace; nothing on a nil trace
+func (t *frameTrace) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if err := t.w.Flush(); err != nil {
+		t.f.Close()
+		return err
+	}
+	return t.f.Close()
+}
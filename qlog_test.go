@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFrameTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	qlogDir = dir
+	defer func() {
+		qlogDir = ""
+	}()
+
+	content := randomContent(4 << 20)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+	servers, stop := startServers(t, handler,
+		LinkConfig{Rate: 4 << 20, Delay: 10 * time.Millisecond, Queue: 128 << 10},
+		LinkConfig{Rate: 2 << 20, Delay: 20 * time.Millisecond, Queue: 128 << 10})
+	defer stop()
+	out := tempOutput(t)
+	defer out.Close()
+	res := download("/content", servers, out)
+
+	for path := range servers {
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("path%d.qlog", path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		if !scanner.Scan() || !bytes.Contains(scanner.Bytes(), []byte(`"qlog_version"`)) {
+			t.Fatalf("path %d: no qlog header", path)
+		}
+		var received int64
+		var windowUpdates int
+		for scanner.Scan() {
+			var ev qlogEvent
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				t.Fatalf("%s: %v", scanner.Text(), err)
+			}
+			switch {
+			case ev.Name == "http2:frame_received" && ev.Data.Frame.FrameType == "data":
+				received += int64(ev.Data.Frame.Length)
+			case ev.Name == "http2:frame_sent" && ev.Data.Frame.FrameType == "window_update":
+				windowUpdates++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		// what was read from the bodies came in DATA frames, some maybe discarded
+		if body := res.Stats[path].Body; received < body || windowUpdates == 0 {
+			t.Errorf("path %d: %d bytes of DATA traced for %d read, %d WINDOW_UPDATE", path,
+				received, body, windowUpdates)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportRecorder keeps what the --report page shows: the bytes every path delivered
+// over time, and the events of the multipath engine
+type reportRecorder struct {
+	points []reportPoint
+	// last indexes the latest point of every range read, by path and start of the range
+	last   map[[2]int]int
+	events []reportEvent
+	mux    sync.Mutex // protects all above
+}
+
+// reportPoint is what a range of a path read in a sample interval
+type reportPoint struct {
+	t      time.Duration
+	path   int
+	offset int64 // in the resource, after the read
+	n      int
+}
+
+type reportEvent struct {
+	t      time.Duration
+	kind   string
+	path   int
+	fields eventFields
+}
+
+// report is the recorder of --report; nil if disabled
+var report *reportRecorder
+
+// progress records a read of n bytes of the range of path from start, up to offset.  The
+// reads within a bwSampleInterval add up to a single point, rather than one per read.
+func (r *reportRecorder) progress(path int, start int, offset int64, n int) {
+	t := time.Since(globalStart)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	key := [2]int{path, start}
+	if i, ok := r.last[key]; ok && r.points[i].t/bwSampleInterval == t/bwSampleInterval {
+		r.points[i].offset = offset
+		r.points[i].n += n
+		return
+	}
+	if r.last == nil {
+		r.last = map[[2]int]int{}
+	}
+	r.last[key] = len(r.points)
+	r.points = append(r.points, reportPoint{t, path, offset, n})
+}
+
+func (r *reportRecorder) event(t time.Duration, kind string, path int, fields eventFields) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.events = append(r.events, reportEvent{t, kind, path, fields})
+}
+
+// field returns a numeric field of an event, 0 if missing
+func (e reportEvent) field(name string) float64 {
+	switch v := e.fields[name].(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// pathColors tell the paths apart in the charts, in the order of the servers
+var pathColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b"}
+
+func pathColor(path int) string {
+	return pathColors[path%len(pathColors)]
+}
+
+// reportPath sums up a path for the table of the report
+type reportPath struct {
+	server     string
+	bytes      int64
+	rttSum     time.Duration
+	rttSamples int
+	minRtt     time.Duration
+	chokes     int
+	duplicated int64
+}
+
+// writeHTML renders a self-contained page with the byte ranges the paths delivered over
+// time, their throughput and RTT, the chokes, and summary stats of the first duration
+// of the run
+func (r *reportRecorder) writeHTML(w io.Writer, title string, duration time.Duration) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if duration <= 0 {
+		duration = time.Millisecond
+	}
+
+	nPaths := 0
+	var maxOffset int64
+	for _, p := range r.points {
+		if p.path >= nPaths {
+			nPaths = p.path + 1
+		}
+		if p.offset > maxOffset {
+			maxOffset = p.offset
+		}
+	}
+	for _, e := range r.events {
+		if e.path >= nPaths {
+			nPaths = e.path + 1
+		}
+	}
+	paths := make([]reportPath, nPaths)
+	var total int64
+	for _, p := range r.points {
+		paths[p.path].bytes += int64(p.n)
+		total += int64(p.n)
+	}
+	for _, e := range r.events {
+		if e.path < 0 || e.t > duration {
+			continue
+		}
+		p := &paths[e.path]
+		switch e.kind {
+		case "connect":
+			p.server, _ = e.fields["server"].(string)
+		case "rtt":
+			rtt := time.Duration(e.field("sample") * float64(time.Millisecond))
+			p.rttSum += rtt
+			p.rttSamples++
+			if p.minRtt == 0 || rtt < p.minRtt {
+				p.minRtt = rtt
+			}
+		case "choke":
+			p.chokes++
+		case "duplicate":
+			p.duplicated += int64(e.field("bytes"))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>mphttp: %s</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 0.8em; text-align: right; border-bottom: 1px solid #ddd; }
+.swatch { display: inline-block; width: 0.8em; height: 0.8em; }
+svg text { font-size: 11px; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+`, html.EscapeString(title), html.EscapeString(title))
+	fmt.Fprintf(&b, "<p>%d bytes read in %v: %s</p>\n", total, duration.Round(time.Millisecond),
+		formatRate(float64(total)/duration.Seconds()))
+	for _, e := range r.events {
+		if e.kind == "estimator" {
+			fmt.Fprintf(&b, "<p>rates estimated with %s, sampled every %vms</p>\n",
+				html.EscapeString(fmt.Sprint(e.fields["name"])), e.field("interval"))
+			break
+		}
+	}
+
+	b.WriteString("<table>\n<tr><th>path</th><th>server</th><th>bytes</th><th>share</th>" +
+		"<th>throughput</th><th>mean RTT</th><th>min RTT</th><th>chokes</th><th>duplicated</th></tr>\n")
+	for i, p := range paths {
+		share, meanRtt := 0.0, time.Duration(0)
+		if total > 0 {
+			share = float64(p.bytes) / float64(total)
+		}
+		if p.rttSamples > 0 {
+			meanRtt = p.rttSum / time.Duration(p.rttSamples)
+		}
+		fmt.Fprintf(&b, `<tr><td><span class="swatch" style="background: %s"></span> %d</td>`+
+			"<td>%s</td><td>%d</td><td>%.0f%%</td><td>%s</td><td>%v</td><td>%v</td><td>%d</td><td>%d</td></tr>\n",
+			pathColor(i), i, html.EscapeString(p.server), p.bytes, share*100,
+			formatRate(float64(p.bytes)/duration.Seconds()), meanRtt.Round(10*time.Microsecond),
+			p.minRtt.Round(10*time.Microsecond), p.chokes, p.duplicated)
+	}
+	b.WriteString("</table>\n")
+
+	secs := duration.Seconds()
+	b.WriteString("<h2>Byte ranges</h2>\n<p>Where in the resource every path was reading; × marks where a path was choked.</p>\n")
+	c := newChart(&b, secs, float64(maxOffset)/1e6, "time (s)", "offset (MB)")
+	for path := 0; path < nPaths; path++ {
+		// one dot per pixel is enough
+		drawn := map[[2]int]bool{}
+		for _, p := range r.points {
+			if p.path != path || p.t > duration {
+				continue
+			}
+			x, y := c.x(p.t.Seconds()), c.y(float64(p.offset)/1e6)
+			if px := [2]int{int(x), int(y)}; !drawn[px] {
+				drawn[px] = true
+				fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="1.2" fill="%s"/>`+"\n", x, y, pathColor(path))
+			}
+		}
+	}
+	for _, e := range r.events {
+		if e.kind == "choke" && e.t <= duration {
+			x, y := c.x(e.t.Seconds()), c.y((e.field("start")+e.field("chokeAt"))/1e6)
+			fmt.Fprintf(&b, `<path d="M%.1f %.1fl8 8m0 -8l-8 8" stroke="%s" stroke-width="2"/>`+"\n",
+				x-4, y-4, pathColor(e.path))
+		}
+	}
+	c.end()
+
+	// throughput in bins of about a hundredth of the run
+	bin := niceStep(secs / 100)
+	if bin < bwSampleInterval.Seconds() {
+		bin = bwSampleInterval.Seconds()
+	}
+	nBins := int(math.Ceil(secs / bin))
+	rates := make([][]float64, nPaths)
+	maxRate := 0.0
+	for i := range rates {
+		rates[i] = make([]float64, nBins)
+	}
+	for _, p := range r.points {
+		if i := int(p.t.Seconds() / bin); i < nBins {
+			rates[p.path][i] += float64(p.n) / bin / 1e6
+			maxRate = math.Max(maxRate, rates[p.path][i])
+		}
+	}
+	b.WriteString("<h2>Throughput</h2>\n")
+	c = newChart(&b, secs, maxRate, "time (s)", "MB/s")
+	for path, bins := range rates {
+		var xs, ys []float64
+		for i, rate := range bins {
+			xs, ys = append(xs, (float64(i)+0.5)*bin), append(ys, rate)
+		}
+		c.polyline(pathColor(path), xs, ys)
+	}
+	c.end()
+
+	// the PING samples, and dashed the smoothed RTT of the kernel
+	xs, ys := make([][]float64, nPaths), make([][]float64, nPaths)
+	kxs, kys := make([][]float64, nPaths), make([][]float64, nPaths)
+	maxRtt := 0.0
+	for _, e := range r.events {
+		if e.path < 0 || e.path >= nPaths || e.t > duration {
+			continue
+		}
+		switch e.kind {
+		case "rtt":
+			rtt := e.field("sample")
+			xs[e.path], ys[e.path] = append(xs[e.path], e.t.Seconds()), append(ys[e.path], rtt)
+			maxRtt = math.Max(maxRtt, rtt)
+		case "tcpinfo":
+			rtt := e.field("rtt")
+			kxs[e.path], kys[e.path] = append(kxs[e.path], e.t.Seconds()), append(kys[e.path], rtt)
+			maxRtt = math.Max(maxRtt, rtt)
+		}
+	}
+	b.WriteString("<h2>RTT</h2>\n")
+	c = newChart(&b, secs, maxRtt, "time (s)", "RTT (ms)")
+	for path := range xs {
+		c.polyline(pathColor(path), xs[path], ys[path])
+		c.dashedPolyline(pathColor(path), kxs[path], kys[path])
+	}
+	c.end()
+
+	b.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// formatRate formats bytes per second
+func formatRate(rate float64) string {
+	switch {
+	case rate >= 1e6:
+		return fmt.Sprintf("%.2f MB/s", rate/1e6)
+	case rate >= 1e3:
+		return fmt.Sprintf("%.1f kB/s", rate/1e3)
+	}
+	return fmt.Sprintf("%.0f B/s", rate)
+}
+
+// niceStep rounds x up to 1, 2 or 5 times a power of ten, for the ticks of an axis
+func niceStep(x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	exp := math.Pow(10, math.Floor(math.Log10(x)))
+	for _, f := range []float64{1, 2, 5} {
+		if x <= f*exp {
+			return f * exp
+		}
+	}
+	return 10 * exp
+}
+
+const (
+	chartWidth  = 800
+	chartHeight = 280
+	chartLeft   = 60 // room for the y axis and its tick labels
+	chartBottom = 40 // for the x axis
+	chartTop    = 10
+	chartRight  = 20
+)
+
+// svgChart maps data onto an SVG plot with axes from zero to xmax and ymax
+type svgChart struct {
+	b          *strings.Builder
+	xmax, ymax float64
+}
+
+func newChart(b *strings.Builder, xmax, ymax float64, xlabel, ylabel string) *svgChart {
+	if xmax <= 0 {
+		xmax = 1
+	}
+	if ymax <= 0 {
+		ymax = 1
+	}
+	c := &svgChart{b: b, xmax: xmax, ymax: ymax}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		chartWidth, chartHeight, chartWidth, chartHeight)
+	step := niceStep(xmax / 8)
+	for v := 0.0; v <= xmax*1.0001; v += step {
+		x := c.x(v)
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#eee"/>`+"\n",
+			x, chartTop, x, chartHeight-chartBottom)
+		fmt.Fprintf(b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n",
+			x, chartHeight-chartBottom+15, strconv.FormatFloat(v, 'g', 4, 64))
+	}
+	step = niceStep(ymax / 5)
+	for v := 0.0; v <= ymax*1.0001; v += step {
+		y := c.y(v)
+		fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`+"\n",
+			chartLeft, y, chartWidth-chartRight, y)
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`+"\n",
+			chartLeft-5, y+4, strconv.FormatFloat(v, 'g', 4, 64))
+	}
+	fmt.Fprintf(b, `<path d="M%d %dV%dH%d" fill="none" stroke="black"/>`+"\n",
+		chartLeft, chartTop, chartHeight-chartBottom, chartWidth-chartRight)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle">%s</text>`+"\n",
+		(chartLeft+chartWidth-chartRight)/2, chartHeight-5, html.EscapeString(xlabel))
+	fmt.Fprintf(b, `<text x="12" y="%d" text-anchor="middle" transform="rotate(-90 12 %d)">%s</text>`+"\n",
+		(chartTop+chartHeight-chartBottom)/2, (chartTop+chartHeight-chartBottom)/2, html.EscapeString(ylabel))
+	return c
+}
+
+func (c *svgChart) x(v float64) float64 {
+	return chartLeft + v/c.xmax*(chartWidth-chartLeft-chartRight)
+}
+
+func (c *svgChart) y(v float64) float64 {
+	return chartHeight - chartBottom - v/c.ymax*(chartHeight-chartBottom-chartTop)
+}
+
+func (c *svgChart) polyline(color string, xs, ys []float64) {
+	c.styledPolyline(color, "", xs, ys)
+}
+
+func (c *svgChart) dashedPolyline(color string, xs, ys []float64) {
+	c.styledPolyline(color, ` stroke-dasharray="4 3"`, xs, ys)
+}
+
+func (c *svgChart) styledPolyline(color, style string, xs, ys []float64) {
+	if len(xs) == 0 {
+		return
+	}
+	points := make([]string, len(xs))
+	for i := range xs {
+		points[i] = fmt.Sprintf("%.1f,%.1f", c.x(xs[i]), c.y(ys[i]))
+	}
+	fmt.Fprintf(c.b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"%s/>`+"\n",
+		strings.Join(points, " "), color, style)
+}
+
+func (c *svgChart) end() {
+	c.b.WriteString("</svg>\n")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNiceStep(t *testing.T) {
+	for _, c := range []struct{ x, want float64 }{
+		{0.7, 1}, {1, 1}, {1.2, 2}, {3, 5}, {7, 10}, {0.013, 0.02}, {450, 500},
+	} {
+		if got := niceStep(c.x); got < c.want*0.999 || got > c.want*1.001 {
+			t.Errorf("niceStep(%v) = %v, want %v", c.x, got, c.want)
+		}
+	}
+}
+
+func TestReportHTML(t *testing.T) {
+	r := &reportRecorder{}
+	ms := time.Millisecond
+	r.event(0, "estimator", -1, eventFields{"name": "ewma", "interval": 10.0})
+	r.event(1*ms, "connect", 0, eventFields{"server": "a<b>:443"})
+	r.event(2*ms, "connect", 1, eventFields{"server": "c:443"})
+	r.event(20*ms, "rtt", 0, eventFields{"sample": 20.0, "rtt": 20.0})
+	r.event(40*ms, "rtt", 0, eventFields{"sample": 40.0, "rtt": 30.0})
+	r.event(30*ms, "rtt", 1, eventFields{"sample": 30.0, "rtt": 30.0})
+	r.event(30*ms, "tcpinfo", 1, eventFields{"rtt": 25.0, "rttvar": 5.0})
+	r.event(500*ms, "choke", 1, eventFields{"start": 500, "chokeAt": int64(100), "inflight": int64(50)})
+	r.event(600*ms, "duplicate", 1, eventFields{"bytes": 7})
+	// after the end of the run
+	r.event(2*time.Second, "rtt", 0, eventFields{"sample": 1000.0})
+	for i := 0; i < 100; i++ {
+		r.points = append(r.points, reportPoint{time.Duration(i) * 10 * ms, i % 2, int64(i*10 + 10), 10})
+	}
+
+	var buf bytes.Buffer
+	if err := r.writeHTML(&buf, "/file & more", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	// the page is XHTML too, so it can be checked for well-formedness
+	dec := xml.NewDecoder(strings.NewReader(page))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("malformed report: %v", err)
+		}
+	}
+	for _, want := range []string{
+		"/file &amp; more", "a&lt;b&gt;:443", "1000 bytes read in 1s",
+		"rates estimated with ewma, sampled every 10ms",
+		// path 0: 500 bytes, mean of the RTT samples within the run
+		"<td>500</td><td>50%</td><td>500 B/s</td><td>30ms</td><td>20ms</td><td>0</td><td>0</td>",
+		"<td>1</td><td>7</td>", "<svg", "<polyline", "<circle", "stroke-dasharray",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("report lacks %q", want)
+		}
+	}
+	if n := strings.Count(page, "<svg"); n != 3 {
+		t.Errorf("%d charts, want 3", n)
+	}
+}
+
+func TestReportProgress(t *testing.T) {
+	globalStart = time.Now()
+	r := &reportRecorder{}
+	// the reads of a sample interval make a single point per range
+	for i := 0; i < 100; i++ {
+		r.progress(0, 0, int64(i+1)*10, 10)
+	}
+	r.progress(0, 5000, 5010, 10)
+	r.progress(1, 0, 10, 10)
+	if len(r.points) != 3 {
+		t.Fatalf("points = %v", r.points)
+	}
+	if p := r.points[0]; p.offset != 1000 || p.n != 1000 {
+		t.Errorf("point of 100 reads = %+v", p)
+	}
+	time.Sleep(bwSampleInterval)
+	r.progress(0, 0, 1010, 10)
+	if len(r.points) != 4 {
+		t.Errorf("points after a sample interval = %v", r.points)
+	}
+}
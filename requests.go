@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 func UnrangedGet(url string) *http.Request {
@@ -36,6 +37,19 @@ func DoubleRangedGetWithCancel(url string, start, end int) (*http.Request, func(
 	return req, cancel
 }
 
+// MultiRangedGet requests several disjoint ranges at once; the server usually answers
+// with a multipart/byteranges body
+func MultiRangedGet(url string, ranges []contentRange) *http.Request {
+	req := UnrangedGet(url)
+	specs := make([]string, len(ranges))
+	for i, r := range ranges {
+		// per RFC 7233, byte ranges are inclusive
+		specs[i] = fmt.Sprintf("%d-%d", r.start, r.end-1)
+	}
+	req.Header.Add("range", "bytes="+strings.Join(specs, ","))
+	return req
+}
+
 func LeftRangedGet(url string, start int) *http.Request {
 	req := UnrangedGet(url)
 	req.Header.Add("range", fmt.Sprintf("bytes=%d-", start))
@@ -6,24 +6,83 @@ import (
 )
 
 const (
-	maxSampleDepth = 5
+	// rttAlpha and rttBeta are the gains of the smoothed RTT and of its variation, as
+	// in RFC 6298
+	rttAlpha = 0.125
+	rttBeta  = 0.25
+	// rttInterval is how often rttMonitor samples the RTT of its path
+	rttInterval = 100 * time.Millisecond
 )
 
+// rttSource is --rtt: how MonitoredMpConn.MeasureRtt knows the RTT of a path, "ping" for
+// the PING frames of rttMonitor or "tcpinfo" for the kernel, see tcpInfoMonitor
+var rttSource = "ping"
+
+// rttMargin is --rttmargin: how many RTT variations the RTT of a path is taken to be
+// above the smoothed RTT when deciding what is in flight, see marginRtt
+var rttMargin float64
+
 type RttMonitor interface {
 	Start()
+	// Stop ends the sampling, returning once no more samples are logged
+	Stop()
+	// GetRtt is the smoothed RTT
 	GetRtt() time.Duration
+	// GetRttVar is the variation of the RTT, the mean deviation from the smoothed RTT
+	GetRttVar() time.Duration
+	// GetMinRtt is the lowest RTT seen
+	GetMinRtt() time.Duration
+}
+
+// marginRtt is the smoothed RTT of mon plus rttMargin variations: how long the bytes
+// in flight on the path take to arrive, with a confidence that grows with the margin
+func marginRtt(mon RttMonitor) time.Duration {
+	return mon.GetRtt() + time.Duration(rttMargin*float64(mon.GetRttVar()))
+}
+
+// rttEstimator smooths RTT samples as TCP does (RFC 6298), and keeps the lowest one
+type rttEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	minRtt time.Duration
+}
+
+func (e *rttEstimator) add(sample time.Duration) {
+	if e.srtt == 0 {
+		e.srtt, e.rttvar, e.minRtt = sample, sample/2, sample
+		return
+	}
+	dev := e.srtt - sample
+	if dev < 0 {
+		dev = -dev
+	}
+	e.rttvar += time.Duration(rttBeta * float64(dev-e.rttvar))
+	e.srtt += time.Duration(rttAlpha * float64(sample-e.srtt))
+	if e.minRtt == 0 || sample < e.minRtt {
+		e.minRtt = sample
+	}
+}
+
+// seed starts the smoothing from what past runs learned of the path, rather than from
+// the first sample; the lowest RTT is left to the samples
+func (e *rttEstimator) seed(p pathProfile) {
+	e.srtt = time.Duration(p.Rtt * float64(time.Millisecond))
+	e.rttvar = time.Duration(p.RttVar * float64(time.Millisecond))
 }
 
 type rttMonitor struct {
-	conn       MpConn
-	historyRtt chan time.Duration
-	rttSum     time.Duration
-	mux        sync.Mutex
+	conn MpConn
+	path int
+	est  rttEstimator
+	mux  sync.Mutex // protects est
+	stop chan struct{}
+	done chan struct{}
 }
 
 func (r *rttMonitor) Start() {
 	ready := make(chan struct{})
 	go func() {
+		defer close(r.done)
 		first := true
 		for {
 			var currentRtt time.Duration
@@ -39,12 +98,10 @@ func (r *rttMonitor) Start() {
 					goto out
 				}
 			}
-			r.historyRtt <- currentRtt
 			r.mux.Lock()
-			r.rttSum += currentRtt
-			if len(r.historyRtt) > maxSampleDepth {
-				r.rttSum -= <-r.historyRtt
-			}
+			r.est.add(currentRtt)
+			logEvent("rtt", r.path, eventFields{"sample": msec(currentRtt), "rtt": msec(r.est.srtt),
+				"rttvar": msec(r.est.rttvar), "minRtt": msec(r.est.minRtt)})
 			r.mux.Unlock()
 		out:
 			if first {
@@ -53,27 +110,50 @@ func (r *rttMonitor) Start() {
 				first = false
 			}
 			//fmt.Printf("rtt for this round: %v\n", r.getRtt())
-			time.Sleep(100 * time.Millisecond)
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(rttInterval):
+			}
 		}
 	}()
 	<-ready
 }
 
-func (r *rttMonitor) getRtt() time.Duration {
-	return time.Duration(int64(r.rttSum/time.Microsecond)/int64(len(r.historyRtt))) * time.Microsecond
+func (r *rttMonitor) Stop() {
+	close(r.stop)
+	<-r.done
 }
 
 func (r *rttMonitor) GetRtt() time.Duration {
 	r.mux.Lock()
 	defer r.mux.Unlock()
-	return r.getRtt()
+	return r.est.srtt
+}
+
+func (r *rttMonitor) GetRttVar() time.Duration {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.est.rttvar
+}
+
+func (r *rttMonitor) GetMinRtt() time.Duration {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.est.minRtt
 }
 
-func NewRttMonitor(conn MpConn) RttMonitor {
-	return &rttMonitor{
-		conn:       conn,
-		historyRtt: make(chan time.Duration, maxSampleDepth+1),
-		rttSum:     0,
-		mux:        sync.Mutex{},
+// NewRttMonitor monitors the path of conn, starting from its profile in the path cache
+// under key if there is one
+func NewRttMonitor(conn MpConn, path int, key string) RttMonitor {
+	r := &rttMonitor{
+		conn: conn,
+		path: path,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if p, ok := pathProfiles.lookup(key, time.Now()); ok && p.Rtt > 0 {
+		r.est.seed(p)
 	}
+	return r
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRttEstimator(t *testing.T) {
+	var est rttEstimator
+	est.add(40 * time.Millisecond)
+	if est.srtt != 40*time.Millisecond || est.rttvar != 20*time.Millisecond || est.minRtt != 40*time.Millisecond {
+		t.Errorf("after the first sample: %+v", est)
+	}
+	// rttvar takes the deviation from the srtt before the sample
+	est.add(24 * time.Millisecond)
+	if est.srtt != 38*time.Millisecond || est.rttvar != 19*time.Millisecond || est.minRtt != 24*time.Millisecond {
+		t.Errorf("after a lower sample: %+v", est)
+	}
+	// a steady RTT wears the variation down
+	for i := 0; i < 100; i++ {
+		est.add(30 * time.Millisecond)
+	}
+	if est.srtt < 29*time.Millisecond || est.srtt > 31*time.Millisecond || est.rttvar > time.Millisecond {
+		t.Errorf("after a steady RTT: %+v", est)
+	}
+	if est.minRtt != 24*time.Millisecond {
+		t.Errorf("min RTT = %v", est.minRtt)
+	}
+}
+
+func TestMarginRtt(t *testing.T) {
+	defer func(margin float64) { rttMargin = margin }(rttMargin)
+	mon := &rttMonitor{}
+	mon.est.add(20 * time.Millisecond)
+	for _, test := range []struct {
+		margin float64
+		rtt    time.Duration
+	}{
+		{0, 20 * time.Millisecond},
+		{1, 30 * time.Millisecond},
+		{2.5, 45 * time.Millisecond},
+	} {
+		rttMargin = test.margin
+		if rtt := marginRtt(mon); rtt != test.rtt {
+			t.Errorf("margin %v: RTT = %v, want %v", test.margin, rtt, test.rtt)
+		}
+	}
+}
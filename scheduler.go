@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Scheduler decides how nSplitRequest spreads a range across the paths, and when the
+// unfinished parts are taken back from the paths to be split again
+type Scheduler interface {
+	// Split assigns start-end to the paths given their rates in bytes per second, zero
+	// while unknown.  Every path must get at least one byte.
+	Split(start, end int, rates []int64) []contentRange
+	// Finishing tells if a path with remaining bytes of its range left, and inflight
+	// bytes on the way, is about to finish; the other paths are then choked
+	Finishing(remaining, inflight int64) bool
+	// ChokeAt returns how much of its range of length bytes a path that has received
+	// progress bytes, with inflight bytes on the way, gets to finish; the rest is split
+	// again.  Returning length lets the path finish its range.
+	ChokeAt(progress, inflight, length int64) int64
+}
+
+// schedulers are selectable by name with --scheduler
+var schedulers = map[string]Scheduler{
+	"proportional": proportionalScheduler{},
+	"equal":        equalScheduler{},
+	"static":       staticScheduler{},
+}
+
+// scheduler is the Scheduler used by nSplitRequest
+var scheduler Scheduler = proportionalScheduler{}
+
+func schedulerNames() string {
+	var names []string
+	for name := range schedulers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// proportionalScheduler splits in proportion to the rates, and once a path gets within
+// an RTT worth of bytes of its end, chokes the others after the bytes they have in
+// flight
+type proportionalScheduler struct{}
+
+func (proportionalScheduler) Split(start, end int, rates []int64) []contentRange {
+	return splitRanges(start, end, rates)
+}
+
+func (proportionalScheduler) Finishing(remaining, inflight int64) bool {
+	return remaining < inflight
+}
+
+func (proportionalScheduler) ChokeAt(progress, inflight, length int64) int64 {
+	return min(progress+inflight, length)
+}
+
+// equalScheduler splits into equal ranges regardless of the rates, refragmenting like
+// proportionalScheduler
+type equalScheduler struct {
+	proportionalScheduler
+}
+
+func (equalScheduler) Split(start, end int, rates []int64) []contentRange {
+	return splitRanges(start, end, make([]int64, len(rates)))
+}
+
+// staticScheduler splits in proportion to the rates but never refragments: every path
+// finishes its range, however slow it turns out to be
+type staticScheduler struct {
+	proportionalScheduler
+}
+
+func (staticScheduler) Finishing(remaining, inflight int64) bool {
+	return remaining <= 0
+}
+
+func (staticScheduler) ChokeAt(progress, inflight, length int64) int64 {
+	return length
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mphttp/dep/http2"
+)
+
+// h2cPrefix marks servers and listeners speaking HTTP/2 over cleartext TCP (with prior
+// knowledge) instead of TLS
+const h2cPrefix = "h2c://"
+
+var serveArgs struct {
+	Dir    string   `arg:"-d" help:"serve the files in <dir>" placeholder:"<dir>"`
+	Cert   string   `help:"TLS certificate in PEM; a self-signed one is generated if omitted" placeholder:"<file>"`
+	Key    string   `help:"TLS key in PEM" placeholder:"<file>"`
+	Listen []string `arg:"positional,required" help:"[h2c://]<addr>[,rate=<rate>][,uprate=<rate>][,delay=<d>][,jitter=<d>][,loss=<p>][,queue=<bytes>][,trace=<file>][,uptrace=<file>]"`
+}
+
+// listenSpec is a listener of the serve command together with its emulated link
+type listenSpec struct {
+	addr     string
+	h2c      bool
+	down, up LinkConfig
+}
+
+func (l listenSpec) shaped() bool {
+	return !l.down.IsZero() || !l.up.IsZero()
+}
+
+// parseRate parses a rate like "8mbit", "1.5MB" or "100000" (bytes per second) into
+// bytes per second.  Prefixes are decimal, as in tc.
+func parseRate(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	divisor := 1.0
+	if strings.HasSuffix(lower, "bit") {
+		lower = strings.TrimSuffix(lower, "bit")
+		divisor = 8
+	} else {
+		lower = strings.TrimSuffix(lower, "b")
+	}
+	multiplier := 1.0
+	if n := len(lower); n > 0 {
+		switch lower[n-1] {
+		case 'k':
+			multiplier = 1e3
+		case 'm':
+			multiplier = 1e6
+		case 'g':
+			multiplier = 1e9
+		}
+		if multiplier != 1 {
+			lower = lower[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(lower, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad rate %q", s)
+	}
+	return int64(v * multiplier / divisor), nil
+}
+
+// parseListenSpec parses "[h2c://]<addr>[,key=value...]".  rate, jitter, loss, queue and
+// trace apply to the downlink (server to client), uprate and uptrace to the uplink, delay
+// to both directions.  Traces are mahimahi packet delivery traces, replacing the rate.
+func parseListenSpec(spec string) (l listenSpec, err error) {
+	fields := strings.Split(spec, ",")
+	l.addr = fields[0]
+	if strings.HasPrefix(l.addr, h2cPrefix) {
+		l.h2c = true
+		l.addr = strings.TrimPrefix(l.addr, h2cPrefix)
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return l, fmt.Errorf("bad option %q in %q", field, spec)
+		}
+		switch kv[0] {
+		case "rate":
+			l.down.Rate, err = parseRate(kv[1])
+		case "uprate":
+			l.up.Rate, err = parseRate(kv[1])
+		case "delay":
+			l.down.Delay, err = time.ParseDuration(kv[1])
+			l.up.Delay = l.down.Delay
+		case "trace":
+			l.down.Trace, err = loadTrace(kv[1])
+		case "uptrace":
+			l.up.Trace, err = loadTrace(kv[1])
+		case "queue":
+			l.down.Queue, err = strconv.ParseInt(kv[1], 10, 64)
+		case "jitter":
+			l.down.Jitter, err = time.ParseDuration(kv[1])
+		case "loss":
+			if strings.HasSuffix(kv[1], "%") {
+				l.down.Loss, err = strconv.ParseFloat(strings.TrimSuffix(kv[1], "%"), 64)
+				l.down.Loss /= 100
+			} else {
+				l.down.Loss, err = strconv.ParseFloat(kv[1], 64)
+			}
+		default:
+			err = fmt.Errorf("unknown option %q in %q", kv[0], spec)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// selfSignedCert generates a certificate for localhost, good enough for mphttp which
+// does not verify certificates anyway
+func selfSignedCert() tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	fatal("generate key", err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"mphttp"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	fatal("create certificate", err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveListener serves handler over HTTP/2 on every connection accepted from l, using
+// the vendored http2.Server.  tlsConfig == nil means h2c with prior knowledge.
+func serveListener(l net.Listener, tlsConfig *tls.Config, handler http.Handler) error {
+	srv := &http2.Server{}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func(c net.Conn) {
+			if tlsConfig != nil {
+				tc := tls.Server(c, tlsConfig)
+				if err := tc.Handshake(); err != nil {
+					log.Printf("TLS handshake with %v: %v", c.RemoteAddr(), err)
+					c.Close()
+					return
+				}
+				c = tc
+			}
+			srv.ServeConn(c, &http2.ServeConnOpts{Handler: handler})
+			c.Close()
+		}(c)
+	}
+}
+
+func serveMain(args []string) {
+	serveArgs.Dir = "."
+	p := mustParseSubcommand("serve", &serveArgs, args)
+	specs := make([]listenSpec, len(serveArgs.Listen))
+	for i := range serveArgs.Listen {
+		var err error
+		if specs[i], err = parseListenSpec(serveArgs.Listen[i]); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+
+	var cert tls.Certificate
+	if serveArgs.Cert != "" {
+		var err error
+		cert, err = tls.LoadX509KeyPair(serveArgs.Cert, serveArgs.Key)
+		fatal("load certificate", err)
+	} else {
+		cert = selfSignedCert()
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{http2.NextProtoTLS},
+	}
+	// http.FileServer serves ranges, including multipart/byteranges
+	handler := http.FileServer(http.Dir(serveArgs.Dir))
+
+	errCh := make(chan error)
+	for _, spec := range specs {
+		l, err := net.Listen("tcp", spec.addr)
+		fatal("listen on "+spec.addr, err)
+		if spec.shaped() {
+			l = &linkListener{Listener: l, down: spec.down, up: spec.up}
+		}
+		cfg := tlsConfig
+		proto := "h2"
+		if spec.h2c {
+			cfg = nil
+			proto = "h2c"
+		}
+		fmt.Printf("Serving %s over %s on %v (down %v, up %v)\n",
+			serveArgs.Dir, proto, l.Addr(), spec.down, spec.up)
+		go func(l net.Listener, cfg *tls.Config) {
+			errCh <- serveListener(l, cfg, handler)
+		}(l, cfg)
+	}
+	fatal("serve", <-errCh)
+}
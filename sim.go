@@ -0,0 +1,661 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// simTick is the resolution of the simulated clock
+	simTick = time.Millisecond
+	// simStreamWindow is the stream flow control window the transport grants initially and
+	// keeps topping up (transportDefaultStreamFlow of dep/http2)
+	simStreamWindow = 4 << 20
+	// simTimeout ends a simulation that does not finish, e.g. because a scheduler never
+	// lets the last bytes be fetched
+	simTimeout = time.Hour
+)
+
+// simPath is a path of the simulator: a bottleneck shared fairly by the streams on it
+type simPath struct {
+	Rate   int64         // bytes per second
+	RTT    time.Duration // round-trip time, which the RTT monitor samples every rttInterval
+	Loss   float64       // probability that a packet is lost, stalling the path for a retransmission timeout
+	Window int64         // stream flow control window; simStreamWindow if zero
+}
+
+// simPaths turns emulated links into simulated paths: the delay is taken for both
+// directions, a trace by its average rate
+func simPaths(links []LinkConfig) ([]simPath, error) {
+	paths := make([]simPath, len(links))
+	for i, link := range links {
+		if link.rate() <= 0 {
+			return nil, fmt.Errorf("link %d has no rate to simulate", i)
+		}
+		paths[i] = simPath{Rate: link.rate(), RTT: 2 * link.Delay, Loss: link.Loss}
+	}
+	return paths, nil
+}
+
+// simResult describes a simulated download
+type simResult struct {
+	Duration time.Duration
+	Stats    []connStats      // per path: bytes read by the client, bytes received
+	Splits   [][]contentRange // every split the scheduler made, in order
+	Missing  int64            // bytes of the resource nobody read; non-zero is a bug
+}
+
+// simStream is a response on a simulated path
+type simStream struct {
+	path     int
+	off      int64         // offset of the first byte in the resource
+	reqLen   int64         // bytes requested
+	want     int64         // bytes the reader takes; less than reqLen once choked
+	read     bool          // false for responses nobody reads
+	dataAt   time.Duration // arrival of the first byte
+	closedAt time.Duration // when the client reset the stream; -1 while open
+	granted  int64         // flow control credit of the server
+	pulled   bool          // the credit grows only by pulls of the rate sampler, see --pull
+	choked   bool          // the credit is topped up to want and no further
+	recv     int64         // bytes arrived
+	consumed int64         // bytes read
+	sampled  int64         // consumed at the last rate sample
+	sampling bool          // the rate sampler of nSplitRequest runs
+}
+
+func (s *simStream) finished() bool {
+	return s.consumed == s.want || s.closedAt >= 0
+}
+
+const (
+	simMonitoring = iota // waiting for a path to get close to its end
+	simFragments         // splitting the choked remainders, one after another
+	simWaiting           // waiting for the own streams to finish
+)
+
+// simLevel is an invocation of nSplitRequest
+type simLevel struct {
+	start, end int
+	race       bool // too short to split: the same range on all paths
+	bw         []*BwCounter
+	ranges     []contentRange
+	streams    []*simStream
+	monitorAt  time.Duration // the choke monitor starts once every response has arrived
+	phase      int
+	newBw      []*BwCounter
+	frags      []contentRange
+	child      *simLevel
+}
+
+type simulator struct {
+	sched        Scheduler
+	paths        []simPath // in the order of the connections
+	length       int
+	rng          *rand.Rand
+	now          time.Duration
+	readyAt      []time.Duration // when the connections become usable
+	mons         []*rttMonitor   // the RTT the paths are known to have, see marginRtt
+	rttAt        []time.Duration // the next RTT sample of the paths
+	stalledUntil []time.Duration
+	carry        []float64 // bytes of capacity left from the previous tick
+	streams      []*simStream
+	levels       []*simLevel // running invocations, outermost first
+	res          simResult
+}
+
+// simulate downloads length bytes over paths in virtual time, with sched deciding the
+// splits and chokes as it would in nSplitRequest.  Multi-range requests for small
+// fragments are not simulated.
+func simulate(sched Scheduler, paths []simPath, length int, seed int64) (simResult, error) {
+	// the connections are used in the order their first responses arrive, after the TCP
+	// and TLS handshakes and the request
+	order := make([]int, len(paths))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return paths[order[a]].RTT < paths[order[b]].RTT })
+	s := &simulator{
+		sched:        sched,
+		length:       length,
+		rng:          rand.New(rand.NewSource(seed)),
+		readyAt:      make([]time.Duration, len(paths)),
+		rttAt:        make([]time.Duration, len(paths)),
+		stalledUntil: make([]time.Duration, len(paths)),
+		carry:        make([]float64, len(paths)),
+	}
+	for idx, p := range order {
+		path := paths[p]
+		if path.Window == 0 {
+			path.Window = simStreamWindow
+		}
+		s.paths = append(s.paths, path)
+		s.readyAt[idx] = 3 * path.RTT
+		// the first PING is acknowledged an RTT after the connection is up
+		s.mons = append(s.mons, &rttMonitor{})
+		s.rttAt[idx] = s.readyAt[idx] + path.RTT
+	}
+
+	// range: bytes=0- on every connection; only the first response is read
+	var first *simStream
+	for idx := range s.paths {
+		st := s.newStream(idx, 0, int64(length), pullStreams)
+		st.dataAt = s.readyAt[idx]
+		st.read = false
+		if idx == 0 {
+			first = st
+		}
+	}
+	for s.now < s.readyAt[0] {
+		s.tick()
+	}
+	first.read = true
+	root, err := s.newLevel(0, length, nil, first)
+	if err != nil {
+		return s.res, err
+	}
+	for {
+		done, err := s.advance(root)
+		if err != nil {
+			return s.res, err
+		}
+		if done {
+			break
+		}
+		if s.now > simTimeout {
+			return s.res, fmt.Errorf("download of %d bytes did not finish within %v", length, simTimeout)
+		}
+		s.tick()
+	}
+
+	s.res.Duration = s.now
+	s.res.Stats = make([]connStats, len(paths))
+	var read []contentRange
+	for _, st := range s.streams {
+		stats := &s.res.Stats[order[st.path]]
+		stats.Wire += st.recv
+		stats.Data += st.recv
+		if st.read {
+			stats.Body += st.consumed
+			read = append(read, contentRange{int(st.off), int(st.off + st.consumed)})
+		}
+	}
+	s.res.Missing = int64(length) - coveredBytes(read, length)
+	return s.res, nil
+}
+
+// coveredBytes counts the bytes of 0-length inside the union of ranges
+func coveredBytes(ranges []contentRange, length int) int64 {
+	sort.Slice(ranges, func(a, b int) bool { return ranges[a].start < ranges[b].start })
+	var covered int64
+	pos := 0
+	for _, r := range ranges {
+		if r.start > pos {
+			pos = r.start
+		}
+		if r.end > pos && pos < length {
+			end := r.end
+			if end > length {
+				end = length
+			}
+			covered += int64(end - pos)
+			pos = end
+		}
+	}
+	return covered
+}
+
+// newStream requests length bytes at off on the connection idx, once it is ready; a
+// pulled stream starts with pullMinAhead bytes of credit
+func (s *simulator) newStream(idx int, off, length int64, pulled bool) *simStream {
+	issue := s.now
+	if issue < s.readyAt[idx] {
+		issue = s.readyAt[idx]
+	}
+	st := &simStream{
+		path:     idx,
+		off:      off,
+		reqLen:   length,
+		want:     length,
+		read:     true,
+		dataAt:   issue + s.paths[idx].RTT,
+		closedAt: -1,
+		granted:  s.paths[idx].Window,
+		pulled:   pulled,
+	}
+	if pulled {
+		st.granted = pullMinAhead
+	}
+	s.streams = append(s.streams, st)
+	return st
+}
+
+// newLevel starts an invocation of nSplitRequest for start-end
+func (s *simulator) newLevel(start, end int, bw []*BwCounter, first *simStream) (*simLevel, error) {
+	l := &simLevel{start: start, end: end, bw: bw}
+	if end-start < minSplitSize {
+		l.race = true
+		for idx := range s.paths {
+			if idx == 0 && first != nil {
+				first.want = int64(end - start)
+				l.streams = append(l.streams, first)
+			} else {
+				l.streams = append(l.streams, s.newStream(idx, int64(start), int64(end-start), false))
+			}
+		}
+		s.levels = append(s.levels, l)
+		return l, nil
+	}
+
+	rates := make([]int64, len(s.paths))
+	for i, b := range bw {
+		rates[i] = b.Rate()
+	}
+	l.ranges = s.sched.Split(start, end, rates)
+	s.res.Splits = append(s.res.Splits, l.ranges)
+	pos := start
+	for _, r := range l.ranges {
+		// a range like bytes=10-9 would be answered with 416
+		if r.start != pos || r.end <= r.start {
+			return nil, fmt.Errorf("invalid split of %d-%d: %v", start, end, l.ranges)
+		}
+		pos = r.end
+	}
+	if len(l.ranges) != len(s.paths) || pos != end {
+		return nil, fmt.Errorf("invalid split of %d-%d: %v", start, end, l.ranges)
+	}
+	if l.bw == nil {
+		l.bw = make([]*BwCounter, len(s.paths))
+		for i := range l.bw {
+			l.bw[i] = NewBwCounter(i)
+		}
+	}
+	for idx, r := range l.ranges {
+		var st *simStream
+		if idx == 0 && first != nil {
+			st = first
+			st.want = int64(r.end - r.start)
+		} else {
+			st = s.newStream(idx, int64(r.start), int64(r.end-r.start), pullStreams)
+		}
+		st.sampling = true
+		st.sampled = st.consumed
+		l.streams = append(l.streams, st)
+		if st.dataAt > l.monitorAt {
+			l.monitorAt = st.dataAt
+		}
+	}
+	s.levels = append(s.levels, l)
+	return l, nil
+}
+
+// tick moves the clock forward, delivering what the paths carry in the meantime
+func (s *simulator) tick() {
+	s.now += simTick
+	for idx, path := range s.paths {
+		if s.now >= s.rttAt[idx] {
+			s.mons[idx].est.add(path.RTT)
+			s.rttAt[idx] += rttInterval
+		}
+		if s.now < s.stalledUntil[idx] {
+			s.carry[idx] = 0
+			continue
+		}
+		var active []*simStream
+		for _, st := range s.streams {
+			if st.path != idx || st.dataAt > s.now {
+				continue
+			}
+			// a reset stops the server half an RTT later, and its last bytes arrive
+			// another half an RTT after that
+			if st.closedAt >= 0 && s.now >= st.closedAt+path.RTT {
+				continue
+			}
+			if st.recv < min(st.granted, st.reqLen) {
+				active = append(active, st)
+			}
+		}
+		if len(active) == 0 {
+			s.carry[idx] = 0
+			continue
+		}
+		// share the capacity fairly, the streams needing less than their share first
+		capacity := float64(path.Rate)*simTick.Seconds() + s.carry[idx]
+		sort.Slice(active, func(a, b int) bool {
+			return min(active[a].granted, active[a].reqLen)-active[a].recv <
+				min(active[b].granted, active[b].reqLen)-active[b].recv
+		})
+		var delivered int64
+		for i, st := range active {
+			share := int64(capacity / float64(len(active)-i))
+			if need := min(st.granted, st.reqLen) - st.recv; share > need {
+				share = need
+			}
+			st.recv += share
+			capacity -= float64(share)
+			delivered += share
+		}
+		s.carry[idx] = capacity
+		if path.Loss > 0 && delivered > 0 {
+			packets := float64((delivered + linkMTU - 1) / linkMTU)
+			if s.rng.Float64() < 1-math.Pow(1-path.Loss, packets) {
+				s.stalledUntil[idx] = s.now + linkMinRTO + path.RTT
+			}
+		}
+	}
+
+	for _, st := range s.streams {
+		if !st.read || st.closedAt >= 0 {
+			continue
+		}
+		st.consumed = min(st.recv, st.want)
+		if !st.pulled {
+			// the transport tops the window up as the body is read
+			s.grant(st, st.consumed+s.paths[st.path].Window)
+		}
+		if st.choked && st.recv >= st.want || st.consumed == st.want && st.want < st.reqLen {
+			// the transport resets a choked stream once the choke point arrives; other
+			// bodies are closed once read, resetting the stream too
+			st.closedAt = s.now
+		}
+	}
+
+	if s.now%bwSampleInterval == 0 {
+		for _, l := range s.levels {
+			for _, st := range l.streams {
+				if !st.sampling || st.dataAt > s.now {
+					continue
+				}
+				l.bw[st.path].AddRate((st.consumed - st.sampled) * int64(time.Second/bwSampleInterval))
+				st.sampled = st.consumed
+				if st.finished() {
+					st.sampling = false
+				} else if st.pulled {
+					// as the rate sampler of nSplitRequest
+					s.grant(st, st.consumed+pullAhead(l.bw[st.path].Rate(), s.mons[st.path].GetRtt()))
+				}
+			}
+		}
+	}
+}
+
+// grant raises the credit of st to granted, as far as its choke point at most
+func (s *simulator) grant(st *simStream, granted int64) {
+	if st.choked {
+		granted = min(granted, st.want)
+	}
+	if granted > st.granted {
+		st.granted = granted
+	}
+}
+
+// choke ends st at chokeAt bytes as ClientStream.ChokeAt does: credit up to the choke
+// point, and no more.  It fails, as the transport does, once the reader is past it.
+func (s *simulator) choke(st *simStream, chokeAt int64) bool {
+	if chokeAt <= 0 || chokeAt < st.consumed {
+		return false
+	}
+	st.want = chokeAt
+	st.choked = true
+	return true
+}
+
+// advance runs the logic of nSplitRequest for l at the current time, and tells if l has
+// returned
+func (s *simulator) advance(l *simLevel) (bool, error) {
+	if l.race {
+		for _, st := range l.streams {
+			if st.consumed == st.want {
+				for _, other := range l.streams {
+					if other != st && other.closedAt < 0 {
+						other.closedAt = s.now
+					}
+				}
+				s.finish(l)
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if l.phase == simMonitoring {
+		if s.now < l.monitorAt || s.now%bwSampleInterval != 0 {
+			return false, nil
+		}
+		progress, inflight := make([]int64, len(l.streams)), make([]int64, len(l.streams))
+		for idx, st := range l.streams {
+			progress[idx] = st.consumed
+			inflight[idx] = inflightBytes(l.bw[idx].Rate(), marginRtt(s.mons[idx]))
+		}
+		finishing, chokeAt := chokePoints(s.sched, l.ranges, progress, inflight)
+		if finishing >= 0 {
+			for i, st := range l.streams {
+				r := l.ranges[i]
+				if i == finishing || chokeAt[i] == int64(r.end-r.start) || !s.choke(st, chokeAt[i]) {
+					continue
+				}
+				if newStart := r.start + int(chokeAt[i]); newStart < r.end {
+					l.frags = append(l.frags, contentRange{newStart, r.end})
+				}
+			}
+			l.newBw = make([]*BwCounter, len(l.bw))
+			for i := range l.bw {
+				l.newBw[i] = l.bw[i].DuplicateBwCounter(i)
+			}
+			l.phase = simFragments
+		}
+	}
+
+	for l.phase == simFragments {
+		if l.child != nil {
+			done, err := s.advance(l.child)
+			if !done || err != nil {
+				return false, err
+			}
+			l.child = nil
+		}
+		if len(l.frags) == 0 {
+			l.phase = simWaiting
+			break
+		}
+		frag := l.frags[0]
+		l.frags = l.frags[1:]
+		child, err := s.newLevel(frag.start, frag.end, l.newBw, nil)
+		if err != nil {
+			return false, err
+		}
+		l.child = child
+	}
+
+	if l.phase == simWaiting {
+		for _, st := range l.streams {
+			if st.consumed != st.want {
+				return false, nil
+			}
+		}
+		s.finish(l)
+		return true, nil
+	}
+	return false, nil
+}
+
+// finish removes l from the running invocations
+func (s *simulator) finish(l *simLevel) {
+	for i := range s.levels {
+		if s.levels[i] == l {
+			s.levels = append(s.levels[:i], s.levels[i+1:]...)
+			return
+		}
+	}
+}
+
+var simArgs struct {
+	Profiles   []string `arg:"--profile,separate" help:"link profile to simulate, as for bench" placeholder:"<profile>"`
+	Schedulers []string `arg:"--scheduler,separate" help:"scheduler to compare (default: all)" placeholder:"<name>"`
+	Estimator  string   `arg:"--estimator" help:"how the rate of a path is estimated, as for a download" placeholder:"<name>"`
+	Pull       bool     `arg:"--pull" help:"pull the ranges split across the paths, as for a download"`
+	RttMargin  float64  `arg:"--rttmargin" help:"RTT variations added to the RTT of a path when choking, as for a download" placeholder:"<k>"`
+	Sizes      []string `arg:"--size,separate" help:"size of the simulated downloads, e.g. 8MB" placeholder:"<size>"`
+	Reps       int      `arg:"-n" help:"repetitions of every scenario, with different loss patterns" placeholder:"<n>"`
+	Seed       int64    `arg:"--seed" help:"seed of the first repetition" placeholder:"<n>"`
+	Fuzz       int      `arg:"--fuzz" help:"instead of the scenarios, simulate <n> random paths and sizes per scheduler and report the failures" placeholder:"<n>"`
+	Format     string   `arg:"-f" help:"report format: table, csv or json" placeholder:"<format>"`
+	Output     string   `arg:"-o" help:"write the report to <file> instead of stdout" placeholder:"<file>"`
+}
+
+// simRun turns a simulated download into a run of the bench report
+func simRun(sc benchScenario, rep int, paths []simPath, res simResult) benchRun {
+	run := benchRun{
+		benchScenario: sc,
+		Rep:           rep,
+		Seconds:       res.Duration.Seconds(),
+		Goodput:       float64(sc.Size) / res.Duration.Seconds(),
+	}
+	var body, data, wire int64
+	for i, stats := range res.Stats {
+		run.PathBytes = append(run.PathBytes, stats.Body)
+		run.Utilization = append(run.Utilization, float64(stats.Body)/res.Duration.Seconds()/float64(paths[i].Rate))
+		body += stats.Body
+		data += stats.Data
+		wire += stats.Wire
+	}
+	run.Duplicated = body - int64(sc.Size)
+	run.Wasted = data - body
+	run.Overhead = wire - body
+	return run
+}
+
+// randomSimPaths draws paths from 100KB/s to 10MB/s with RTTs up to 300ms, some of them
+// lossy
+func randomSimPaths(rng *rand.Rand) []simPath {
+	paths := make([]simPath, serverCount)
+	for i := range paths {
+		paths[i].Rate = int64(1e5 * math.Pow(100, rng.Float64()))
+		paths[i].RTT = time.Duration(1+rng.Intn(300)) * time.Millisecond
+		if rng.Intn(4) == 0 {
+			paths[i].Loss = rng.Float64() * 0.02
+		}
+	}
+	return paths
+}
+
+// randomSimSize draws sizes of all magnitudes up to 16MB, including the tiny ones that
+// are raced rather than split
+func randomSimSize(rng *rand.Rand) int {
+	return 1 + int(math.Pow(2, rng.Float64()*24))
+}
+
+// simFuzz simulates n random downloads with sched, returning a description of every one
+// that failed or lost bytes
+func simFuzz(sched Scheduler, n int, seed int64) []string {
+	var failures []string
+	rng := rand.New(rand.NewSource(seed))
+	for i := 0; i < n; i++ {
+		paths, size := randomSimPaths(rng), randomSimSize(rng)
+		res, err := simulate(sched, paths, size, int64(i))
+		if err == nil && res.Missing != 0 {
+			err = fmt.Errorf("%d bytes never read", res.Missing)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%d bytes over %+v, seed %d: %v", size, paths, i, err))
+		}
+	}
+	return failures
+}
+
+func simMain(args []string) {
+	simArgs.Reps = 100
+	simArgs.Format = "table"
+	simArgs.Estimator = "mean"
+	p := mustParseSubcommand("sim", &simArgs, args)
+	if _, ok := estimators[simArgs.Estimator]; !ok {
+		p.Fail("unknown estimator " + simArgs.Estimator + "; known: " + estimatorNames())
+	}
+	estimatorName = simArgs.Estimator
+	pullStreams = simArgs.Pull
+	if simArgs.RttMargin < 0 {
+		p.Fail("--rttmargin must not be negative")
+	}
+	rttMargin = simArgs.RttMargin
+	switch simArgs.Format {
+	case "table", "csv", "json":
+	default:
+		p.Fail("unknown format " + simArgs.Format)
+	}
+	if len(simArgs.Schedulers) == 0 {
+		for name := range schedulers {
+			simArgs.Schedulers = append(simArgs.Schedulers, name)
+		}
+		sort.Strings(simArgs.Schedulers)
+	}
+	for _, name := range simArgs.Schedulers {
+		if _, ok := schedulers[name]; !ok {
+			p.Fail("unknown scheduler " + name + "; known: " + schedulerNames())
+		}
+	}
+
+	if simArgs.Fuzz > 0 {
+		failed := false
+		for _, name := range simArgs.Schedulers {
+			failures := simFuzz(schedulers[name], simArgs.Fuzz, simArgs.Seed)
+			fmt.Printf("sim: %s: %d of %d downloads failed\n", name, len(failures), simArgs.Fuzz)
+			for _, f := range failures {
+				fmt.Println("  " + f)
+			}
+			failed = failed || len(failures) > 0
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(simArgs.Profiles) == 0 {
+		simArgs.Profiles = []string{"equal", "asymmetric", "lossy"}
+	}
+	if len(simArgs.Sizes) == 0 {
+		simArgs.Sizes = []string{"1MB", "8MB"}
+	}
+	var sizes []int
+	for _, s := range simArgs.Sizes {
+		size, err := parseRate(s)
+		if err != nil || size <= 0 {
+			p.Fail("bad size " + s)
+		}
+		sizes = append(sizes, int(size))
+	}
+	var runs []benchRun
+	for _, profile := range simArgs.Profiles {
+		links, err := parseProfile(profile)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		paths, err := simPaths(links)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		for _, name := range simArgs.Schedulers {
+			for _, size := range sizes {
+				sc := benchScenario{Profile: profile, Scheduler: name, Path: "/" + strconv.Itoa(size), Size: size}
+				for rep := 0; rep < simArgs.Reps; rep++ {
+					res, err := simulate(schedulers[name], paths, size, simArgs.Seed+int64(rep))
+					fatal(fmt.Sprintf("simulate %s with %s", profile, name), err)
+					runs = append(runs, simRun(sc, rep, paths, res))
+				}
+			}
+		}
+	}
+
+	w := os.Stdout
+	if simArgs.Output != "" {
+		f, err := os.Create(simArgs.Output)
+		fatal("create report", err)
+		defer f.Close()
+		w = f
+	}
+	fatal("write report", writeBenchReport(w, simArgs.Format, runs, summarize(runs)))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitRangesRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		// ranges beyond the 24 bits of a float32 mantissa, and rates from nothing to 10GB/s
+		start := rng.Intn(1 << 20)
+		end := start + minSplitSize + rng.Intn(1<<(12+uint(rng.Intn(28))))
+		rates := make([]int64, serverCount)
+		for j := range rates {
+			if rng.Intn(4) != 0 {
+				rates[j] = rng.Int63n(1 << uint(1+rng.Intn(34)))
+			}
+		}
+		ranges := splitRanges(start, end, rates)
+		pos := start
+		for _, r := range ranges {
+			if r.start != pos || r.end <= r.start {
+				t.Fatalf("splitRanges(%d, %d, %v) = %v", start, end, rates, ranges)
+			}
+			pos = r.end
+		}
+		if len(ranges) != len(rates) || pos != end {
+			t.Fatalf("splitRanges(%d, %d, %v) = %v", start, end, rates, ranges)
+		}
+	}
+}
+
+func TestSimulateSchedulers(t *testing.T) {
+	links, err := parseProfile("asymmetric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := simPaths(links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]simResult{}
+	for name, sched := range schedulers {
+		res, err := simulate(sched, paths, 8e6, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if res.Missing != 0 {
+			t.Errorf("%s: %d bytes missing", name, res.Missing)
+		}
+		results[name] = res
+	}
+	// static never refragments, so the equal first split leaves 2.7MB on the 1MB/s path
+	static := results["static"]
+	if len(static.Splits) != 1 || static.Duration < 2600*time.Millisecond {
+		t.Errorf("static: %d splits in %v", len(static.Splits), static.Duration)
+	}
+	var body int64
+	for _, stats := range static.Stats {
+		body += stats.Body
+	}
+	if body != 8e6 {
+		t.Errorf("static: read %d bytes, want no duplicates", body)
+	}
+	// 8MB over 7MB/s of capacity
+	if d := results["proportional"].Duration; d < 1100*time.Millisecond || d > static.Duration {
+		t.Errorf("proportional took %v, static %v", d, static.Duration)
+	}
+}
+
+func TestSimulateFlags(t *testing.T) {
+	defer func(pull bool, margin float64) { pullStreams, rttMargin = pull, margin }(pullStreams, rttMargin)
+	links, err := parseProfile("asymmetric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := simPaths(links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(pull bool, margin float64) (simResult, int64) {
+		pullStreams, rttMargin = pull, margin
+		res, err := simulate(schedulers["proportional"], paths, 8e6, 0)
+		if err != nil {
+			t.Fatalf("pull %v, margin %v: %v", pull, margin, err)
+		}
+		if res.Missing != 0 {
+			t.Errorf("pull %v, margin %v: %d bytes missing", pull, margin, res.Missing)
+		}
+		var wasted int64
+		for _, stats := range res.Stats {
+			wasted += stats.Data - stats.Body
+		}
+		return res, wasted
+	}
+	res, wasted := run(false, 0)
+	// the spare responses and the choked streams only get their credit
+	if _, pulled := run(true, 0); pulled > wasted/2 {
+		t.Errorf("pulled streams wasted %d bytes, %d otherwise", pulled, wasted)
+	}
+	// what is in flight, and so where the paths are choked, grows with the margin
+	if margined, _ := run(false, 4); reflect.DeepEqual(margined.Splits, res.Splits) {
+		t.Errorf("the splits ignore the RTT margin: %v", res.Splits)
+	}
+}
+
+func TestSimulateRandom(t *testing.T) {
+	n := 300
+	if testing.Short() {
+		n = 30
+	}
+	for name, sched := range schedulers {
+		for _, f := range simFuzz(sched, n, 1) {
+			t.Errorf("%s: %s", name, f)
+		}
+	}
+}
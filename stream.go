@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	// streamChunkSize is the size of a single read from the streaming response
+	streamChunkSize = 32 << 10
+	// probeStep is the initial distance ahead of the stream at which we look for the end
+	// of the resource; it doubles on every probe that still hits content
+	probeStep = 1 << 20
+)
+
+// streamCursor tracks how far the sequential stream has written to the output and where
+// it has to stop because the rest has been handed to other paths
+type streamCursor struct {
+	pos   int
+	limit int // -1 means no limit: read until EOF
+	mux   sync.Mutex
+}
+
+func (c *streamCursor) position() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.pos
+}
+
+// cut limits the stream to its share of the bytes before end and returns the split point,
+// or -1 if what is left is too short to be worth splitting.
+func (c *streamCursor) cut(end int, nPaths int) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	remaining := end - c.pos
+	if remaining < minSplitSize*nPaths {
+		return -1
+	}
+	c.limit = c.pos + remaining/nPaths
+	return c.limit
+}
+
+// readStream copies body to out at the cursor position until EOF or the cursor limit.
+// Returns true if the body has been read until EOF.
+func readStream(body io.ReadCloser, out io.WriterAt, cur *streamCursor) bool {
+	defer body.Close()
+	chunk := make([]byte, streamChunkSize)
+	for {
+		n, err := body.Read(chunk)
+		cur.mux.Lock()
+		if cur.limit >= 0 && cur.pos+n > cur.limit {
+			n = cur.limit - cur.pos
+		}
+		_, werr := out.WriteAt(chunk[:n], int64(cur.pos))
+		fatal("write stream output", werr)
+		cur.pos += n
+		reached := cur.limit >= 0 && cur.pos >= cur.limit
+		cur.mux.Unlock()
+		if reached {
+			return false
+		}
+		if err == io.EOF {
+			return true
+		}
+		fatal("read stream body", err)
+	}
+}
+
+// probeAt requests the single byte at offset and returns the status code together with
+// the total length, if the server disclosed it in Content-Range.
+func probeAt(url string, conn MonitoredMpConn, offset int) (status int, total int) {
+	rs := conn.StartRequest(DoubleRangedGet(url, offset, offset+1))
+	if rs.response == nil {
+		return 0, unknownLength
+	}
+	rs.response.Body.Close()
+	total = unknownLength
+	if cr := rs.response.Header.Get("Content-Range"); cr != "" {
+		if _, _, t, err := parseContentRange(cr); err == nil {
+			total = t
+		}
+	}
+	return rs.response.StatusCode, total
+}
+
+// probeEnd finds the current end of the resource beyond offset from with single-byte
+// ranged requests at exponentially growing distances, then bisects between the last hit
+// and the first 416.  If the server discloses the length on the way, that is returned
+// directly; otherwise the result is a lower bound within minSplitSize of the real end.
+// ok is false if the server does not serve ranges.
+func probeEnd(url string, conn MonitoredMpConn, from int) (end int, ok bool) {
+	lo, hi := from, -1
+	for step := probeStep; hi < 0; step *= 2 {
+		status, total := probeAt(url, conn, lo+step-1)
+		if total != unknownLength {
+			return total, true
+		}
+		switch status {
+		case http.StatusPartialContent:
+			lo += step
+		case http.StatusRequestedRangeNotSatisfiable:
+			hi = lo + step - 1
+		default:
+			return 0, false
+		}
+	}
+	for hi-lo > minSplitSize {
+		mid := lo + (hi-lo)/2
+		status, total := probeAt(url, conn, mid)
+		if total != unknownLength {
+			return total, true
+		}
+		switch status {
+		case http.StatusPartialContent:
+			lo = mid + 1
+		case http.StatusRequestedRangeNotSatisfiable:
+			hi = mid
+		default:
+			return 0, false
+		}
+	}
+	return lo, true
+}
+
+// streamRequest downloads a resource whose length is not known up front, writing it to
+// out directly, and returns the final length.
+// firstResponse is read sequentially on conns[0], while conns[1] probes ahead for the
+// end of the resource.  Once found, the stream is cut at its share and the rest is
+// split across the other paths with nSplitRequest.  Afterwards the stream is reopened
+// where the split ended, so content appended in the meantime is picked up as well, until
+// the server answers 416.
+func streamRequest(url string, conns []MonitoredMpConn, connsReady []chan struct{},
+	firstResponse *responseStream, out io.WriterAt) int {
+	cur := &streamCursor{limit: -1}
+	body := firstResponse.response.Body
+	for {
+		eof := make(chan bool, 1)
+		go func(body io.ReadCloser, cur *streamCursor) {
+			eof <- readStream(body, out, cur)
+		}(body, cur)
+
+		splitAt, splitEnd := -1, -1
+		var buf rangeBuf
+		if len(conns) > 1 {
+			<-connsReady[1]
+			if end, ok := probeEnd(url, conns[1], cur.position()); ok {
+				if splitAt = cur.cut(end, len(conns)); splitAt >= 0 {
+					logf("Stream at %d, splitting %d-%d\n", cur.position(), splitAt, end)
+					splitEnd = end
+					// only what the other paths fetch is held here
+					buf = rangeBuf{b: make([]byte, end-splitAt), offset: splitAt}
+					nSplitRequest(url, conns[1:], connsReady[1:], nil, splitAt, splitEnd, buf, nil)
+				}
+			}
+		}
+
+		reachedEOF := <-eof
+		if splitEnd < 0 {
+			// nothing was handed to other paths: the stream saw everything there is
+			return cur.pos
+		}
+		if reachedEOF && cur.pos < splitAt {
+			// the response was shorter than what the probe found (the resource grew
+			// after the stream had started): fill in the gap on all paths
+			gap := rangeBuf{b: make([]byte, splitAt-cur.pos), offset: cur.pos}
+			nSplitRequest(url, conns, connsReady, nil, cur.pos, splitAt, gap, nil)
+			_, err := out.WriteAt(gap.b, int64(gap.offset))
+			fatal("write split output", err)
+		}
+		_, err := out.WriteAt(buf.b, int64(buf.offset))
+		fatal("write split output", err)
+
+		rs := conns[0].StartRequest(LeftRangedGet(url, splitEnd))
+		if rs.response == nil || rs.response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			if rs.response != nil {
+				rs.response.Body.Close()
+			}
+			return splitEnd
+		}
+		if rs.response.StatusCode != http.StatusPartialContent {
+			log.Panicf("unexpected status code from server: %d", rs.response.StatusCode)
+		}
+		cur = &streamCursor{pos: splitEnd, limit: -1}
+		body = rs.response.Body
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// tcpInfoInterval is how often tcpInfoMonitor reads TCP_INFO
+const tcpInfoInterval = 100 * time.Millisecond
+
+// tcpInfo is what the kernel knows of the TCP connection of a path, see readTCPInfo
+type tcpInfo struct {
+	Rtt          time.Duration // smoothed
+	RttVar       time.Duration
+	MinRtt       time.Duration // the lowest seen; 0 on kernels before 4.6
+	DeliveryRate int64         // of the recent deliveries, in bytes per second; 0 before 4.9
+	Cwnd         uint32        // congestion window, in segments
+	Retransmits  uint32        // segments retransmitted since the connection started
+}
+
+// tcpInfoMonitor is the RttMonitor of --rtt tcpinfo: the smoothed RTT of the kernel, which
+// unlike a PING does not wait behind the DATA frames queued on the connection or for the
+// server to answer.  The delay of the links emulated by mphttp serve is added above TCP,
+// so the kernel does not see it.
+type tcpInfoMonitor struct {
+	conn MpConn
+	path int
+	info tcpInfo
+	mux  sync.Mutex // protects info
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newTCPInfoMonitor(conn MpConn, path int) RttMonitor {
+	return &tcpInfoMonitor{conn: conn, path: path, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Start samples TCP_INFO every tcpInfoInterval, until stopped or the connection is closed;
+// nothing where TCP_INFO is not available
+func (m *tcpInfoMonitor) Start() {
+	info, err := m.conn.TCPInfo()
+	if err != nil {
+		if rttSource == "tcpinfo" {
+			log.Printf("TCP_INFO of path %d: %v", m.path, err)
+		}
+		close(m.done)
+		return
+	}
+	m.record(info)
+	go func() {
+		defer close(m.done)
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(tcpInfoInterval):
+			}
+			info, err := m.conn.TCPInfo()
+			if err != nil {
+				return
+			}
+			m.record(info)
+		}
+	}()
+}
+
+func (m *tcpInfoMonitor) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *tcpInfoMonitor) record(info tcpInfo) {
+	m.mux.Lock()
+	m.info = info
+	m.mux.Unlock()
+	logEvent("tcpinfo", m.path, eventFields{"rtt": msec(info.Rtt), "rttvar": msec(info.RttVar),
+		"minRtt": msec(info.MinRtt), "deliveryRate": info.DeliveryRate, "cwnd": info.Cwnd,
+		"retransmits": info.Retransmits})
+}
+
+func (m *tcpInfoMonitor) GetRtt() time.Duration {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.info.Rtt
+}
+
+func (m *tcpInfoMonitor) GetRttVar() time.Duration {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.info.RttVar
+}
+
+func (m *tcpInfoMonitor) GetMinRtt() time.Duration {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.info.MinRtt
+}
@@ -0,0 +1,59 @@
+//go:build !386
+// +build !386
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const tcpInfoSupported = true
+
+// linuxTCPInfo is struct tcp_info of linux/tcp.h, up to tcpi_delivery_rate; older
+// kernels leave the fields they do not know zero
+type linuxTCPInfo struct {
+	syscall.TCPInfo
+	PacingRate    uint64
+	MaxPacingRate uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+	SegsOut       uint32
+	SegsIn        uint32
+	NotsentBytes  uint32
+	MinRtt        uint32
+	DataSegsIn    uint32
+	DataSegsOut   uint32
+	DeliveryRate  uint64
+}
+
+func readTCPInfo(c *net.TCPConn) (tcpInfo, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return tcpInfo{}, err
+	}
+	var info linuxTCPInfo
+	size := uint32(unsafe.Sizeof(info))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return tcpInfo{}, err
+	}
+	if errno != 0 {
+		return tcpInfo{}, os.NewSyscallError("getsockopt", errno)
+	}
+	return tcpInfo{
+		Rtt:          time.Duration(info.Rtt) * time.Microsecond,
+		RttVar:       time.Duration(info.Rttvar) * time.Microsecond,
+		MinRtt:       time.Duration(info.MinRtt) * time.Microsecond,
+		DeliveryRate: int64(info.DeliveryRate),
+		Cwnd:         info.Snd_cwnd,
+		Retransmits:  info.Total_retrans,
+	}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const tcpInfoSupported = false
+
+func readTCPInfo(c *net.TCPConn) (tcpInfo, error) {
+	return tcpInfo{}, errors.New("TCP_INFO is only read on linux")
+}
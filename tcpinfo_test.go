@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTCPInfoMonitor(t *testing.T) {
+	if !tcpInfoSupported {
+		t.Skip("TCP_INFO is not read on this platform")
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	servers, stop := startServers(t, handler, LinkConfig{})
+	defer stop()
+	conn := NewMpConn(servers[0], nil)
+	defer conn.Close()
+
+	info, err := conn.TCPInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the connection went through the TLS handshake: the kernel has sampled its RTT
+	if info.Rtt <= 0 || info.Cwnd == 0 {
+		t.Errorf("TCP_INFO = %+v", info)
+	}
+	mon := newTCPInfoMonitor(conn, 0)
+	mon.Start()
+	if mon.GetRtt() <= 0 {
+		t.Errorf("monitored RTT = %v", mon.GetRtt())
+	}
+}
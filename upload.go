@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// uploadFirstRound is the size of the first upload round per path; each round doubles
+	// in size as the rate estimates get better
+	uploadFirstRound = 1 << 20
+	// uploadRetries is how many times a failed range is resumed before giving up
+	uploadRetries = 3
+	tusVersion    = "1.0.0"
+)
+
+var uploadArgs struct {
+	Path     string   `arg:"-t,required" help:"the absolute file path (or tus endpoint) on the server" placeholder:"<file>"`
+	Input    string   `arg:"-i,required" help:"upload <file>" placeholder:"<file>"`
+	Protocol string   `arg:"-p" help:"upload protocol: put (Content-Range PUT) or tus (resumable, concatenation extension)" placeholder:"<put|tus>"`
+	Servers  []string `arg:"positional,required"`
+}
+
+// uploader sends the ranges of a file to the server
+type uploader interface {
+	// send uploads the range over conn, returning the bytes of the request that carried
+	// the body and how long it took, which the rate of the path is measured with
+	send(conn MonitoredMpConn, r contentRange) (int, time.Duration, error)
+	// finish completes the upload once every range has been sent
+	finish(conn MonitoredMpConn) error
+}
+
+func uploadMain(args []string) {
+	uploadArgs.Protocol = "put"
+	p := mustParseSubcommand("upload", &uploadArgs, args)
+	if len(uploadArgs.Servers) != serverCount {
+		p.Fail("must provide exactly 3 servers")
+	}
+	normalizeServers(uploadArgs.Servers)
+
+	f, err := os.Open(uploadArgs.Input)
+	fatal("open file", err)
+	defer f.Close()
+	info, err := f.Stat()
+	fatal("stat file", err)
+	size := int(info.Size())
+
+	var up uploader
+	switch uploadArgs.Protocol {
+	case "put":
+		up = &putUploader{url: uploadArgs.Path, f: f, size: size}
+	case "tus":
+		up = &tusUploader{url: uploadArgs.Path, f: f, parts: map[int]string{}}
+	default:
+		p.Fail("unknown protocol " + uploadArgs.Protocol)
+	}
+
+	globalStart = time.Now()
+	s := newSession(uploadArgs.Servers)
+	defer s.Close()
+	nUploadRequest(s, up, size)
+	fatal("finish upload", up.finish(s.conns[s.fastestConn()]))
+	fmt.Printf("%s (%d bytes) uploaded in %v\n", uploadArgs.Input, size, time.Since(globalStart))
+}
+
+// nUploadRequest uploads size bytes in rounds of doubling size.  Each round is split
+// across the paths with splitRanges according to the upload rates measured in the
+// previous rounds, so that all paths finish their share at about the same time.
+func nUploadRequest(s *session, up uploader, size int) {
+	nConns := len(s.conns)
+	bw := make([]*BwCounter, nConns)
+	for i := range bw {
+		bw[i] = NewBwCounter(i)
+	}
+	roundSize := uploadFirstRound * nConns
+	for start := 0; start < size; roundSize *= 2 {
+		end := start + roundSize
+		if end > size {
+			end = size
+		}
+		rates := make([]int64, nConns)
+		for i := range bw {
+			rates[i] = bw[i].Rate()
+		}
+		ranges := splitRanges(start, end, rates)
+		logf("%v\n", ranges)
+
+		wg := sync.WaitGroup{}
+		for idx := range ranges {
+			r := ranges[idx]
+			if r.start == r.end {
+				continue
+			}
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				<-s.connsReady[idx]
+				conn := s.conns[idx]
+				n, elapsed, err := up.send(conn, r)
+				for retry := 0; err != nil && retry < uploadRetries; retry++ {
+					log.Printf("upload of %d-%d on connection #%d: %v, resuming", r.start, r.end, idx, err)
+					n, elapsed, err = up.send(conn, r)
+				}
+				fatal(fmt.Sprintf("upload %d-%d on connection #%d", r.start, r.end, idx), err)
+				// the request took one extra RTT to get the response back
+				elapsed -= conn.mon.GetRtt()
+				if n > 0 && elapsed > 0 {
+					bw[idx].AddRate(int64(n) * int64(time.Second) / int64(elapsed))
+				}
+			}(idx)
+		}
+		wg.Wait()
+		start = end
+	}
+}
+
+// finishResponse drains and closes the body of an upload response, returning an error
+// unless the status is 2xx
+func finishResponse(rs responseStream) (*http.Response, error) {
+	if rs.response == nil {
+		return nil, fmt.Errorf("request failed")
+	}
+	io.Copy(ioutil.Discard, rs.response.Body)
+	rs.response.Body.Close()
+	if rs.response.StatusCode/100 != 2 {
+		return rs.response, fmt.Errorf("unexpected status code from server: %d", rs.response.StatusCode)
+	}
+	return rs.response, nil
+}
+
+// transfer sends req, which carries the body of a range, returning how long it took
+// until the response
+func transfer(conn MonitoredMpConn, req *http.Request) (time.Duration, error) {
+	start := time.Now()
+	_, err := finishResponse(conn.StartRequest(req))
+	return time.Since(start), err
+}
+
+// putUploader sends every range as a PUT with Content-Range, which servers supporting
+// partial PUT write at the given offset of the target
+type putUploader struct {
+	url  string
+	f    io.ReaderAt
+	size int
+}
+
+func (u *putUploader) send(conn MonitoredMpConn, r contentRange) (int, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPut, u.url, io.NewSectionReader(u.f, int64(r.start), int64(r.end-r.start)))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.ContentLength = int64(r.end - r.start)
+	// per RFC 7233, byte ranges are inclusive
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", r.start, r.end-1, u.size))
+	elapsed, err := transfer(conn, req)
+	return r.end - r.start, elapsed, err
+}
+
+// finish creates an empty file, which has no range to send: a Content-Range cannot
+// describe zero bytes, so it is a plain PUT
+func (u *putUploader) finish(conn MonitoredMpConn) error {
+	if u.size > 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPut, u.url, http.NoBody)
+	if err != nil {
+		return err
+	}
+	_, err = finishResponse(conn.StartRequest(req))
+	return err
+}
+
+// tusUploader uploads every range as a partial upload of the tus concatenation extension
+// (https://tus.io/protocols/resumable-upload.html#concatenation), and concatenates them
+// into the final upload in the end.  Interrupted partial uploads resume where the server
+// says they stopped.
+type tusUploader struct {
+	url   string
+	f     io.ReaderAt
+	parts map[int]string // range start -> partial upload URL
+	final string         // URL of the concatenated upload
+	mux   sync.Mutex     // protects parts
+}
+
+func (u *tusUploader) newRequest(method, target string, body io.Reader) *http.Request {
+	req, err := http.NewRequest(method, target, body)
+	fatal("gen request", err)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return req
+}
+
+// location resolves the Location of a creation response against the endpoint
+func (u *tusUploader) location(resp *http.Response) (string, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", fmt.Errorf("no Location in tus creation response")
+	}
+	base, err := url.Parse(u.url)
+	if err != nil {
+		return "", err
+	}
+	ref, err := base.Parse(loc)
+	if err != nil {
+		return "", err
+	}
+	return ref.String(), nil
+}
+
+func (u *tusUploader) send(conn MonitoredMpConn, r contentRange) (int, time.Duration, error) {
+	u.mux.Lock()
+	part, created := u.parts[r.start]
+	u.mux.Unlock()
+	offset := 0
+	if !created {
+		req := u.newRequest(http.MethodPost, u.url, nil)
+		req.Header.Set("Upload-Length", strconv.Itoa(r.end-r.start))
+		req.Header.Set("Upload-Concat", "partial")
+		resp, err := finishResponse(conn.StartRequest(req))
+		if err != nil {
+			return 0, 0, err
+		}
+		if part, err = u.location(resp); err != nil {
+			return 0, 0, err
+		}
+		u.mux.Lock()
+		u.parts[r.start] = part
+		u.mux.Unlock()
+	} else {
+		// resuming: ask how far the previous attempt got
+		resp, err := finishResponse(conn.StartRequest(u.newRequest(http.MethodHead, part, nil)))
+		if err != nil {
+			return 0, 0, err
+		}
+		value := resp.Header.Get("Upload-Offset")
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 || offset > r.end-r.start {
+			return 0, 0, fmt.Errorf("bad Upload-Offset %q for %d bytes", value, r.end-r.start)
+		}
+	}
+
+	body := io.NewSectionReader(u.f, int64(r.start+offset), int64(r.end-r.start-offset))
+	req := u.newRequest(http.MethodPatch, part, body)
+	req.ContentLength = int64(r.end - r.start - offset)
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	elapsed, err := transfer(conn, req)
+	return r.end - r.start - offset, elapsed, err
+}
+
+func (u *tusUploader) finish(conn MonitoredMpConn) error {
+	u.mux.Lock()
+	starts := make([]int, 0, len(u.parts))
+	for start := range u.parts {
+		starts = append(starts, start)
+	}
+	u.mux.Unlock()
+	sort.Ints(starts)
+	locs := make([]string, len(starts))
+	for i, start := range starts {
+		locs[i] = u.parts[start]
+	}
+
+	req := u.newRequest(http.MethodPost, u.url, nil)
+	if len(locs) > 0 {
+		req.Header.Set("Upload-Concat", "final;"+strings.Join(locs, " "))
+	} else {
+		// an empty file has no partial uploads to concatenate, and is complete on creation
+		req.Header.Set("Upload-Length", "0")
+	}
+	resp, err := finishResponse(conn.StartRequest(req))
+	if err != nil {
+		return err
+	}
+	if u.final, err = u.location(resp); err != nil {
+		return err
+	}
+	fmt.Printf("tus upload available at %s\n", u.final)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// partialPutServer writes the Content-Range PUTs of an upload into its file
+type partialPutServer struct {
+	mux  sync.Mutex
+	file []byte
+}
+
+func (s *partialPutServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || r.Method != http.MethodPut {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	cr := r.Header.Get("Content-Range")
+	if cr == "" {
+		s.file = body
+		return
+	}
+	start, end, total, err := parseContentRange(cr)
+	if err != nil || end-start != len(body) || end > total {
+		http.Error(w, "bad Content-Range", http.StatusBadRequest)
+		return
+	}
+	if s.file == nil {
+		s.file = make([]byte, total)
+	}
+	copy(s.file[start:end], body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusServer implements the creation and concatenation extensions of tus.  The first
+// PATCH fails halfway through, for the client to resume it.
+type tusServer struct {
+	mux         sync.Mutex
+	uploads     map[string][]byte // location -> bytes received
+	lengths     map[string]int
+	interrupted bool
+	resumed     bool // a PATCH started past the first byte
+	final       []byte
+	finished    bool
+}
+
+func (s *tusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || r.Header.Get("Tus-Resumable") != tusVersion {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	loc := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Upload-Concat"), "final;"):
+		for _, part := range strings.Fields(strings.TrimPrefix(r.Header.Get("Upload-Concat"), "final;")) {
+			if len(s.uploads[part]) != s.lengths[part] {
+				http.Error(w, "incomplete partial upload "+part, http.StatusBadRequest)
+				return
+			}
+			s.final = append(s.final, s.uploads[part]...)
+		}
+		s.finished = true
+		w.Header().Set("Location", "/files/final")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && r.Header.Get("Upload-Concat") == "partial":
+		length, err := strconv.Atoi(r.Header.Get("Upload-Length"))
+		if err != nil {
+			http.Error(w, "bad Upload-Length", http.StatusBadRequest)
+			return
+		}
+		loc = fmt.Sprintf("/files/%d", len(s.uploads))
+		s.uploads[loc], s.lengths[loc] = []byte{}, length
+		w.Header().Set("Location", loc)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && r.Header.Get("Upload-Length") == "0":
+		s.finished = true
+		w.Header().Set("Location", "/files/final")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead && s.uploads[loc] != nil:
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.uploads[loc])))
+	case r.Method == http.MethodPatch && s.uploads[loc] != nil:
+		offset, err := strconv.Atoi(r.Header.Get("Upload-Offset"))
+		if err != nil || offset != len(s.uploads[loc]) || offset+len(body) > s.lengths[loc] {
+			http.Error(w, "bad Upload-Offset", http.StatusConflict)
+			return
+		}
+		if offset > 0 {
+			s.resumed = true
+		}
+		if !s.interrupted && len(body) > 1 {
+			s.interrupted = true
+			s.uploads[loc] = append(s.uploads[loc], body[:len(body)/2]...)
+			http.Error(w, "interrupted", http.StatusInternalServerError)
+			return
+		}
+		s.uploads[loc] = append(s.uploads[loc], body...)
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.uploads[loc])))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// upload sends content through a handler on three unshaped paths
+func upload(t *testing.T, handler http.Handler, newUploader func(f *bytes.Reader) uploader, content []byte) {
+	servers, stop := startServers(t, handler, LinkConfig{}, LinkConfig{}, LinkConfig{})
+	defer stop()
+	s := newSession(servers)
+	defer s.Close()
+	up := newUploader(bytes.NewReader(content))
+	nUploadRequest(s, up, len(content))
+	if err := up.finish(s.conns[s.fastestConn()]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadPut(t *testing.T) {
+	// two rounds, the second one split by the rates of the first
+	for _, size := range []int{0, 5 << 20} {
+		content := randomContent(size)
+		server := &partialPutServer{}
+		upload(t, server, func(f *bytes.Reader) uploader {
+			return &putUploader{url: "/file", f: f, size: size}
+		}, content)
+		if server.file == nil || !bytes.Equal(server.file, content) {
+			t.Errorf("%d bytes: %d bytes uploaded, or they differ", size, len(server.file))
+		}
+	}
+}
+
+func TestUploadTus(t *testing.T) {
+	for _, size := range []int{0, 5 << 20} {
+		content := randomContent(size)
+		server := &tusServer{uploads: map[string][]byte{}, lengths: map[string]int{}}
+		var up *tusUploader
+		upload(t, server, func(f *bytes.Reader) uploader {
+			up = &tusUploader{url: "/files/", f: f, parts: map[int]string{}}
+			return up
+		}, content)
+		if !server.finished || !bytes.Equal(server.final, content) {
+			t.Errorf("%d bytes: %d bytes uploaded, or they differ", size, len(server.final))
+		}
+		if up.final != "/files/final" {
+			t.Errorf("%d bytes: final upload at %q", size, up.final)
+		}
+		if size > 0 && !server.resumed {
+			t.Errorf("%d bytes: the interrupted partial upload was not resumed", size)
+		}
+	}
+}
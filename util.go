@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -22,22 +25,73 @@ func printHeaders(response *http.Response) {
 	}
 }
 
+// unknownLength is returned by getTotalLength when the server did not tell us the
+// full length of the resource (Content-Range "bytes a-b/*"), or does not serve ranges
+const unknownLength = -1
+
 func getTotalLength(response *http.Response) int {
 	//printHeaders(response)
 	contentRanges, found := response.Header["Content-Range"]
 	if !found {
-		log.Fatal("no Content-Range header present")
+		// the server ignored our range: the whole resource can only be streamed from
+		// this response, as the ranges that would split it would come back whole too
+		return unknownLength
 	}
 	if len(contentRanges) != 1 {
 		log.Fatal("multiple Content-Range header present")
 	}
-	slashIdx := strings.Index(contentRanges[0], "/")
+	_, _, ret, err := parseContentRange(contentRanges[0])
+	fatal("parse Content-Range in getTotalLength", err)
+	return ret
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes a-b/len",
+// "bytes a-b/*" or "bytes */len" (the latter is sent along with 416).  The returned
+// end is exclusive; start and end are -1 for the unsatisfied form and total is
+// unknownLength for "*".
+func parseContentRange(contentRange string) (start, end, total int, err error) {
+	const unit = "bytes "
+	if !strings.HasPrefix(contentRange, unit) {
+		return 0, 0, 0, fmt.Errorf("unsupported Content-Range %q", contentRange)
+	}
+	spec := contentRange[len(unit):]
+	slashIdx := strings.Index(spec, "/")
 	if slashIdx < 0 {
-		log.Fatal("no slash (/) in Content-Range header")
+		return 0, 0, 0, fmt.Errorf("no slash (/) in Content-Range %q", contentRange)
 	}
-	ret, err := strconv.Atoi(contentRanges[0][slashIdx+1:])
-	fatal("atoi in getTotalLength", err)
-	return ret
+	rng, length := spec[:slashIdx], spec[slashIdx+1:]
+	if length == "*" {
+		total = unknownLength
+	} else if total, err = strconv.Atoi(length); err != nil {
+		return
+	}
+	if rng == "*" {
+		return -1, -1, total, nil
+	}
+	dashIdx := strings.Index(rng, "-")
+	if dashIdx < 0 {
+		return 0, 0, 0, fmt.Errorf("no dash (-) in Content-Range %q", contentRange)
+	}
+	if start, err = strconv.Atoi(rng[:dashIdx]); err != nil {
+		return
+	}
+	if end, err = strconv.Atoi(rng[dashIdx+1:]); err != nil {
+		return
+	}
+	// per RFC 7233, byte ranges are inclusive
+	end++
+	return
+}
+
+// hashFile returns the sha256 of the whole content of f
+func hashFile(f *os.File) (sum [sha256.Size]byte) {
+	_, err := f.Seek(0, io.SeekStart)
+	fatal("seek for hash", err)
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	fatal("read for hash", err)
+	copy(sum[:], h.Sum(nil))
+	return
 }
 
 func min(a, b int64) int64 {